@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// requestIDKey is the key of the ID of a request in its context
+const requestIDKey = "request_id"
+
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,200}$`)
+
+// requestIDMiddleware gives an ID to each request, which is answered in the
+// X-Request-Id header and recorded in the audit log. It keeps the ID set by a
+// proxy, such as the Heroku router, so that their logs can be correlated
+func requestIDMiddleware(c *gin.Context) {
+	id := c.Request.Header.Get("X-Request-Id")
+	if !requestIDRegexp.MatchString(id) {
+		var err error
+		if id, err = newToken(); err != nil {
+			log.Printf("couldn't generate a request ID: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	c.Set(requestIDKey, id)
+	c.Header("X-Request-Id", id)
+}
+
+// audit records an entry of the audit log in tx, so that it is only kept if
+// the change is committed. The changes of tasks are also published to the
+// subscribers of GET /events. resource is the path of the changed resource, e.g.
+// /tasks/1. before and after are its values, nil when it didn't exist or
+// doesn't anymore, and patch is the patch document that changed it, if any
+func audit(c *gin.Context, tx *sqlx.Tx, action, resource string, before, after, patch interface{}) error {
+	// The actor is nil when users sign up by themselves
+	var actorID *int
+	if user, ok := c.Get(gin.AuthUserKey); ok {
+		id := user.(User).ID
+		actorID = &id
+	}
+	requestID, _ := c.Get(requestIDKey)
+
+	values := make([]*string, 3)
+	for i, value := range []interface{}{before, after, patch} {
+		if value == nil {
+			continue
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		s := string(b)
+		values[i] = &s
+	}
+	if _, err := tx.Stmtx(insertAuditEntry).Exec(actorID, requestID, action, resource, values[0], values[1], values[2]); err != nil {
+		return err
+	}
+	return publishTaskEvent(tx, action, resource, actorID, values[0], values[1])
+}
+
+// auditTasks records the updates of tasks that changed along with another
+// resource, from their state before. A task changed twice is recorded once.
+// Like audit, it must be called after the writes of tx
+func auditTasks(c *gin.Context, tx *sqlx.Tx, tasks []TaskResource) error {
+	audited := map[int]bool{}
+	for _, task := range tasks {
+		if audited[task.ID] {
+			continue
+		}
+		audited[task.ID] = true
+		var after TaskResource
+		if err := tx.Stmtx(selectTaskWhereID).Get(&after, task.ID); err != nil {
+			return err
+		}
+		if err := audit(c, tx, "update", "/tasks/"+strconv.Itoa(task.ID), task, after, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// getAuditHandler answers the entries of the audit log, newest first. They can
+// be filtered by actor_id, by resource, which also matches the resources under
+// it, by action, and by created_after and created_before. They are paginated
+// like tasks, with limit and cursor
+func getAuditHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, auditRead); !ok {
+		return
+	}
+
+	var query sqlQuery
+	limit := defaultLimit
+	if v, ok := c.GetQuery("limit"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			c.JSON(http.StatusBadRequest, &ParamError{"limit", fmt.Sprintf("must be an integer between 1 and %d", maxLimit)})
+			return
+		}
+		limit = n
+	}
+	if v, ok := c.GetQuery("actor_id"); ok {
+		actorID, err := strconv.Atoi(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, &ParamError{"actor_id", "must be an integer"})
+			return
+		}
+		query.Where("audit_log.actor_id = ?", actorID)
+	}
+	if v, ok := c.GetQuery("resource"); ok {
+		resource := strings.TrimSuffix(v, "/")
+		if !strings.HasPrefix(resource, "/") {
+			c.JSON(http.StatusBadRequest, &ParamError{"resource", "must be a path, e.g. /tasks/1"})
+			return
+		}
+		query.Where("(audit_log.resource = ? OR audit_log.resource LIKE ?)", resource, likeEscaper.Replace(resource)+"/%")
+	}
+	if v, ok := c.GetQuery("action"); ok {
+		query.Where("audit_log.action = ?", v)
+	}
+	for _, param := range []struct{ name, clause string }{
+		{"created_after", "audit_log.created_at > ?"},
+		{"created_before", "audit_log.created_at < ?"},
+	} {
+		if v, ok := c.GetQuery(param.name); ok {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, &ParamError{param.name, "must be a RFC 3339 date"})
+				return
+			}
+			query.Where(param.clause, t)
+		}
+	}
+	if v, ok := c.GetQuery("cursor"); ok {
+		cur, err := parseCursor(v)
+		if err != nil || cur.Sort != "-id" {
+			c.JSON(http.StatusBadRequest, &ParamError{"cursor", "malformed cursor"})
+			return
+		}
+		query.Where("audit_log.id < ?", cur.ID)
+	}
+
+	entries := []AuditEntryResource{}
+	err := db.Select(&entries, db.Rebind(selectAuditEntries+query.WhereClause()+"\n\t\tORDER BY audit_log.id DESC\n\t\tLIMIT ?"), append(query.args, limit+1)...)
+	if err != nil {
+		log.Printf("couldn't select from audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var next *cursor
+	if len(entries) > limit {
+		entries = entries[:limit]
+		next = &cursor{Sort: "-id", ID: entries[limit-1].ID}
+	}
+
+	setLinkHeader(c, next)
+	c.JSON(http.StatusOK, entries)
+}
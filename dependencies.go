@@ -0,0 +1,297 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// taskGraphLockID is the key of the advisory lock that serializes the
+// insertions of dependencies, so that two concurrent ones can't build a cycle
+const taskGraphLockID = 4244
+
+// dependency is an edge of the dependency graph: the task can't start before
+// the blocker is done
+type dependency struct {
+	TaskID    int `db:"task_id"`
+	BlockerID int `db:"blocker_id"`
+}
+
+// upstreamTasks and downstreamTasks select the IDs of the tasks that block
+// the task ?, directly or not, and of the ones that it blocks
+const (
+	upstreamTasks = `tasks.id IN (WITH RECURSIVE upstream (id) AS (
+			SELECT blocker_id FROM task_dependencies WHERE task_id = ?
+			UNION
+			SELECT task_dependencies.blocker_id FROM task_dependencies JOIN upstream ON task_dependencies.task_id = upstream.id
+		) SELECT id FROM upstream)`
+	downstreamTasks = `tasks.id IN (WITH RECURSIVE downstream (id) AS (
+			SELECT task_id FROM task_dependencies WHERE blocker_id = ?
+			UNION
+			SELECT task_dependencies.task_id FROM task_dependencies JOIN downstream ON task_dependencies.blocker_id = downstream.id
+		) SELECT id FROM downstream)`
+)
+
+// postTasksIDDependenciesHandler makes a task depend on a blocker. It fails if
+// the blocker already depends on the task
+func postTasksIDDependenciesHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var task TaskResource
+	if _, ok := selectAuthorizedTask(c, &task, taskEdit); !ok {
+		return
+	}
+
+	var body struct {
+		BlockerID int `json:"blocker_id" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if body.BlockerID == task.ID {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "blocker_id", Message: "a task can't block itself"})
+		return
+	}
+	var blocker TaskResource
+	err := selectTaskWhereID.Get(&blocker, body.BlockerID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "blocker_id", Message: fmt.Sprintf("task %d doesn't exist", body.BlockerID)})
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, ok := authorizeTask(c, user, &blocker, taskView); !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, taskGraphLockID); err != nil {
+		log.Printf("couldn't lock task_dependencies: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var cycle bool
+	if err := tx.Stmtx(selectTaskDependsOn).Get(&cycle, blocker.ID, task.ID); err != nil {
+		log.Printf("couldn't select from task_dependencies: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if cycle {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "blocker_id", Message: fmt.Sprintf("task %d already depends on task %d", blocker.ID, task.ID)})
+		return
+	}
+	if _, err := tx.Stmtx(insertTaskDependency).Exec(task.ID, blocker.ID); err != nil {
+		log.Printf("couldn't insert to task_dependencies: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(bumpTaskVersion).Exec(task.ID, nil); err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	dependency := gin.H{"task_id": task.ID, "blocker_id": blocker.ID}
+	if err := audit(c, tx, "create", "/tasks/"+strconv.Itoa(task.ID)+"/dependencies/"+strconv.Itoa(blocker.ID), nil, dependency, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusCreated, "", nil)
+}
+
+func deleteTasksIDDependenciesBlockerIDHandler(c *gin.Context) {
+	var task TaskResource
+	if _, ok := selectAuthorizedTask(c, &task, taskEdit); !ok {
+		return
+	}
+
+	blockerID, err := strconv.Atoi(c.Param("blocker_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Stmtx(deleteTaskDependency).Exec(task.ID, blockerID)
+	if err != nil {
+		log.Printf("couldn't delete from task_dependencies: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if _, err := tx.Stmtx(bumpTaskVersion).Exec(task.ID, nil); err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	dependency := gin.H{"task_id": task.ID, "blocker_id": blockerID}
+	if err := audit(c, tx, "delete", "/tasks/"+strconv.Itoa(task.ID)+"/dependencies/"+strconv.Itoa(blockerID), dependency, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// getTasksIDUpstreamHandler lists the tasks that block a task, directly or
+// not. With direct=true, only its direct blockers are listed
+func getTasksIDUpstreamHandler(c *gin.Context) {
+	listDependencies(c, upstreamTasks, "tasks.id IN (SELECT blocker_id FROM task_dependencies WHERE task_id = ?)")
+}
+
+// getTasksIDDownstreamHandler lists the tasks that a task blocks, directly or
+// not. With direct=true, only the tasks it directly blocks are listed
+func getTasksIDDownstreamHandler(c *gin.Context) {
+	listDependencies(c, downstreamTasks, "tasks.id IN (SELECT task_id FROM task_dependencies WHERE blocker_id = ?)")
+}
+
+func listDependencies(c *gin.Context, transitive, direct string) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	clause := transitive
+	if v, ok := c.GetQuery("direct"); ok {
+		isDirect, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, &ParamError{"direct", "must be a boolean"})
+			return
+		}
+		if isDirect {
+			clause = direct
+		}
+	}
+
+	listTasks(c, func(query *taskQuery) {
+		query.Where(clause, id)
+	})
+}
+
+// criticalPath returns the longest chain of dependencies in a graph, as the
+// task IDs from the first blocker to the task. The graph must be acyclic.
+// Chains of the same length are compared by their IDs, so that the result
+// doesn't depend on the order of the dependencies
+func criticalPath(taskID int, dependencies []dependency) []int {
+	blockers := make(map[int][]int)
+	for _, d := range dependencies {
+		blockers[d.TaskID] = append(blockers[d.TaskID], d.BlockerID)
+	}
+
+	// longest[id] is the longest chain that ends with id, from its first
+	// blocker to id
+	longest := make(map[int][]int)
+	var visit func(id int) []int
+	visit = func(id int) []int {
+		if chain, ok := longest[id]; ok {
+			return chain
+		}
+		var best []int
+		for _, blocker := range blockers[id] {
+			chain := visit(blocker)
+			if len(chain) > len(best) || len(chain) == len(best) && lessChain(chain, best) {
+				best = chain
+			}
+		}
+		chain := append(append([]int{}, best...), id)
+		longest[id] = chain
+		return chain
+	}
+	return visit(taskID)
+}
+
+// lessChain compares two chains of the same length lexicographically
+func lessChain(a, b []int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// getTasksIDCriticalPathHandler answers the longest chain of unfinished
+// blockers of a task, from the one to finish first to its direct blocker. The
+// blockers the user can't view are answered with their ID only
+func getTasksIDCriticalPathHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var task TaskResource
+	if _, ok := selectAuthorizedTask(c, &task, taskView); !ok {
+		return
+	}
+	id := task.ID
+
+	var dependencies []dependency
+	if err := selectUpstreamDependencies.Select(&dependencies, id, workflow.FinalStatuses()); err != nil {
+		log.Printf("couldn't select from task_dependencies: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	path := criticalPath(id, dependencies)
+	path = path[:len(path)-1]
+
+	tasks := []interface{}{}
+	for _, blockerID := range path {
+		var blocker TaskResource
+		if err := selectTaskWhereID.Get(&blocker, blockerID); err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		role, err := taskRole(user, &blocker)
+		if err != nil {
+			log.Printf("couldn't select roles: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !allows(role, taskView) {
+			tasks = append(tasks, gin.H{"id": blocker.ID})
+			continue
+		}
+		tasks = append(tasks, blocker)
+	}
+
+	c.JSON(http.StatusOK, tasks)
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCriticalPath(t *testing.T) {
+	for _, test := range []struct {
+		dependencies []dependency
+		expected     []int
+	}{
+		{nil, []int{10}},
+		{[]dependency{{10, 1}}, []int{1, 10}},
+		{[]dependency{{10, 1}, {10, 2}, {1, 3}, {3, 4}, {2, 5}}, []int{4, 3, 1, 10}},
+		{[]dependency{{10, 2}, {10, 1}}, []int{1, 10}},
+		{[]dependency{{10, 2}, {10, 1}, {2, 3}, {1, 3}, {3, 4}}, []int{4, 3, 1, 10}},
+	} {
+		if path := criticalPath(10, test.dependencies); !reflect.DeepEqual(path, test.expected) {
+			t.Errorf("%v: expected %v; got %v", test.dependencies, test.expected, path)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// etag returns the strong entity tag of a resource version
+func etag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// parseIfMatch returns the versions accepted by an If-Match header, or nil if
+// any version is accepted ("*"). Weak and malformed entity tags can't match.
+// Unquoted versions are accepted for older clients
+func parseIfMatch(header string) pq.Int64Array {
+	if strings.TrimSpace(header) == "*" {
+		return nil
+	}
+	versions := pq.Int64Array{}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(tag); err == nil {
+			tag = unquoted
+		}
+		if version, err := strconv.ParseInt(tag, 10, 64); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// matchVersion tells whether version is accepted by the versions returned by
+// parseIfMatch
+func matchVersion(versions pq.Int64Array, version int) bool {
+	if versions == nil {
+		return true
+	}
+	for _, v := range versions {
+		if v == int64(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// collectionValidators are the cache validators of a collection. They are
+// computed from the number of rows and their latest update, instead of from
+// the response body
+type collectionValidators struct {
+	Count        int
+	LastModified pq.NullTime `db:"last_modified"`
+}
+
+// Etag returns the weak Etag of the collection. It also depends on the query
+// string, so that every page of a collection has its own Etag
+func (v *collectionValidators) Etag(c *gin.Context) string {
+	h := fnv.New64a()
+	h.Write([]byte(c.Request.URL.RawQuery))
+	return fmt.Sprintf(`W/"%d-%d-%x"`, v.Count, v.LastModified.Time.UnixNano(), h.Sum64())
+}
+
+// notModified sets the Etag and Last-Modified headers of a response. If the
+// request's If-None-Match (or, without it, If-Modified-Since) header shows
+// that the client is up to date, it answers 304 Not Modified and returns true
+func notModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	c.Header("Etag", etag)
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	if ifNoneMatch := c.Request.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		// If-None-Match uses the weak comparison
+		weak := func(tag string) string { return strings.TrimPrefix(strings.TrimSpace(tag), "W/") }
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			if strings.TrimSpace(tag) == "*" || weak(tag) == weak(etag) {
+				c.AbortWithStatus(http.StatusNotModified)
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := c.Request.Header.Get("If-Modified-Since"); ifModifiedSince != "" && !lastModified.IsZero() {
+		t, err := http.ParseTime(ifModifiedSince)
+		if err == nil && !lastModified.Truncate(time.Second).After(t) {
+			c.AbortWithStatus(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Event is something that happened in the task manager and that is sent to
+// the configured sinks
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// EventSink delivers events outside of the task manager. Name identifies the
+// sink, so that the delivery of an event to a sink can be recorded
+type EventSink interface {
+	Name() string
+	Send(event Event) error
+}
+
+// logSink writes events to the standard logger
+type logSink struct{}
+
+func (logSink) Name() string { return "log" }
+
+func (logSink) Send(event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Printf("event %s: %s", event.Type, b)
+	return nil
+}
+
+// hookSink posts events as JSON to an URL. Any response other than a 2xx is a
+// failed delivery
+type hookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newHookSink(url string) *hookSink {
+	return &hookSink{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (s *hookSink) Name() string { return "hook" }
+
+func (s *hookSink) Send(event Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", s.url, resp.Status)
+	}
+	return nil
+}
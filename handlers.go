@@ -2,98 +2,389 @@ package main
 
 import (
 	"database/sql"
-	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 
-	"gopkg.in/asaskevich/govalidator.v4"
+	"github.com/lib/pq"
 	"gopkg.in/gin-gonic/gin.v1"
 )
 
 func init() {
 	router = gin.Default()
-	router.GET("/tasks/", getTasksHandler)
-	router.GET("/tasks/:id", getTasksIDHandler)
-	router.GET("/users/:id/tasks", getUsersIDTasksHandler)
-	router.GET("/tasks/:id/comments", getTasksIDCommentsHandler)
-	router.GET("/users/:id/comments", getUsersIDCommentsHandler)
-	authorized := router.Group("/", authMiddleware)
-	authorized.POST("/tasks/", postTasksHandler)
-	authorized.PATCH("/tasks/:id", patchTasksIDHandler)
-	authorized.POST("/tasks/:id/comments", postTasksIDCommentsHandler)
+	router.Use(requestIDMiddleware)
+	// In the open signup mode, users sign up without being authenticated
+	router.POST("/users/", postUsersHandler)
+	// Every other route needs a token with the scope it declares
+	router.GET("/tasks/", authMiddleware("tasks:read"), getTasksHandler)
+	router.GET("/tasks/:id", authMiddleware("tasks:read"), getTasksIDHandler)
+	router.GET("/users/:id/tasks", authMiddleware("tasks:read"), getUsersIDTasksHandler)
+	router.GET("/tasks/:id/comments", authMiddleware("comments:read"), getTasksIDCommentsHandler)
+	router.GET("/tasks/:id/transitions", authMiddleware("tasks:read"), getTasksIDTransitionsHandler)
+	router.GET("/tasks/:id/subtasks", authMiddleware("tasks:read"), getTasksIDSubtasksHandler)
+	router.GET("/tasks/:id/upstream", authMiddleware("tasks:read"), getTasksIDUpstreamHandler)
+	router.GET("/tasks/:id/downstream", authMiddleware("tasks:read"), getTasksIDDownstreamHandler)
+	router.GET("/tasks/:id/history", authMiddleware("tasks:read"), getTasksIDHistoryHandler)
+	router.GET("/tasks/:id/critical-path", authMiddleware("tasks:read"), getTasksIDCriticalPathHandler)
+	router.GET("/events", authMiddleware("tasks:read"), getEventsHandler)
+	router.GET("/ws", authMiddleware("tasks:read"), getWSHandler)
+	router.GET("/workflow", authMiddleware("tasks:read"), getWorkflowHandler)
+	router.GET("/labels/", authMiddleware("labels:read"), getLabelsHandler)
+	router.GET("/labels/:id", authMiddleware("labels:read"), getLabelsIDHandler)
+	router.GET("/projects/", authMiddleware("projects:read"), getProjectsHandler)
+	router.GET("/projects/:id", authMiddleware("projects:read"), getProjectsIDHandler)
+	router.GET("/projects/:id/members", authMiddleware("projects:read"), getProjectsIDMembersHandler)
+	router.GET("/projects/:id/tasks", authMiddleware("tasks:read"), getProjectsIDTasksHandler)
+	router.GET("/users/:id/comments", authMiddleware("comments:read"), getUsersIDCommentsHandler)
+	router.GET("/roles", authMiddleware("roles:read"), getRolesHandler)
+	router.GET("/users/:id", authMiddleware("users:read"), getUsersIDHandler)
+	router.GET("/tokens/", authMiddleware("tokens:read"), getTokensHandler)
+	router.POST("/tasks/", authMiddleware("tasks:write"), postTasksHandler)
+	router.PATCH("/tasks/:id", authMiddleware("tasks:write"), patchTasksIDHandler)
+	router.DELETE("/tasks/:id", authMiddleware("tasks:write"), deleteTasksIDHandler)
+	router.POST("/tasks/:id/restore", authMiddleware("tasks:write"), postTasksIDRestoreHandler)
+	router.POST("/tasks/:id/revert", authMiddleware("tasks:write"), postTasksIDRevertHandler)
+	router.GET("/trash", authMiddleware("tasks:read"), getTrashHandler)
+	router.POST("/tasks/:id/comments", authMiddleware("comments:write"), postTasksIDCommentsHandler)
+	router.POST("/tasks/:id/subtasks", authMiddleware("tasks:write"), postTasksIDSubtasksHandler)
+	router.POST("/tasks/:id/dependencies", authMiddleware("tasks:write"), postTasksIDDependenciesHandler)
+	router.DELETE("/tasks/:id/dependencies/:blocker_id", authMiddleware("tasks:write"), deleteTasksIDDependenciesBlockerIDHandler)
+	router.POST("/labels/", authMiddleware("labels:write"), postLabelsHandler)
+	router.PATCH("/labels/:id", authMiddleware("labels:write"), patchLabelsIDHandler)
+	router.DELETE("/labels/:id", authMiddleware("labels:write"), deleteLabelsIDHandler)
+	router.POST("/projects/", authMiddleware("projects:write"), postProjectsHandler)
+	router.PATCH("/projects/:id", authMiddleware("projects:write"), patchProjectsIDHandler)
+	router.POST("/projects/:id/members", authMiddleware("projects:write"), postProjectsIDMembersHandler)
+	router.PUT("/projects/:id/members/:user_id", authMiddleware("projects:write"), putProjectsIDMembersUserIDHandler)
+	router.DELETE("/projects/:id/members/:user_id", authMiddleware("projects:write"), deleteProjectsIDMembersUserIDHandler)
+	router.POST("/projects/:id/tasks", authMiddleware("tasks:write"), postProjectsIDTasksHandler)
+	router.PUT("/roles/:user_id", authMiddleware("roles:write"), putRolesUserIDHandler)
+	router.DELETE("/roles/:user_id", authMiddleware("roles:write"), deleteRolesUserIDHandler)
+	router.PATCH("/users/:id", authMiddleware("users:write"), patchUsersIDHandler)
+	router.POST("/users/:id/deactivate", authMiddleware("users:write"), postUsersIDDeactivateHandler)
+	router.POST("/users/:id/reactivate", authMiddleware("users:write"), postUsersIDReactivateHandler)
+	router.PUT("/users/:id/password", authMiddleware("users:write"), putUsersIDPasswordHandler)
+	router.POST("/tokens/", authMiddleware("tokens:write"), postTokensHandler)
+	router.DELETE("/tokens/:id", authMiddleware("tokens:write"), deleteTokensIDHandler)
+	router.POST("/tokens/:id/rotate", authMiddleware("tokens:write"), postTokensIDRotateHandler)
+	router.GET("/oauth/clients/", authMiddleware("clients:read"), getOAuthClientsHandler)
+	router.POST("/oauth/clients/", authMiddleware("clients:write"), postOAuthClientsHandler)
+	router.DELETE("/oauth/clients/:id", authMiddleware("clients:write"), deleteOAuthClientsIDHandler)
+	router.GET("/audit", authMiddleware("audit:read"), getAuditHandler)
+	router.GET("/webhooks/", authMiddleware("webhooks:read"), getWebhooksHandler)
+	router.POST("/webhooks/", authMiddleware("webhooks:write"), postWebhooksHandler)
+	router.DELETE("/webhooks/:id", authMiddleware("webhooks:write"), deleteWebhooksIDHandler)
+	router.GET("/webhooks/:id/deliveries", authMiddleware("webhooks:read"), getWebhooksIDDeliveriesHandler)
+	router.POST("/webhooks/:id/deliveries/:delivery_id/redeliver", authMiddleware("webhooks:write"), postWebhooksIDDeliveriesIDRedeliverHandler)
+	// The OAuth endpoints authenticate users and clients themselves
+	router.GET("/oauth/authorize", getOAuthAuthorizeHandler)
+	router.POST("/oauth/authorize", postOAuthAuthorizeHandler)
+	router.POST("/oauth/token", postOAuthTokenHandler)
+	// The session endpoints authenticate with the session cookie only
+	router.POST("/login", postLoginHandler)
+	router.POST("/logout", postLogoutHandler)
+	router.GET("/session", getSessionHandler)
 }
 
 func getTasksHandler(c *gin.Context) {
-	var tasks []TaskResource
-	if err := selectTasks.Select(&tasks); err != nil {
-		log.Printf("couldn't select from tasks: %v", err)
+	listTasks(c, nil)
+}
+
+func getTasksIDHandler(c *gin.Context) {
+	var task TaskResource
+	if _, ok := selectAuthorizedTask(c, &task, taskView); !ok {
+		return
+	}
+
+	if v, ok := c.GetQuery("as_of"); ok {
+		answerTaskAsOf(c, task.ID, v)
+		return
+	}
+	if notModified(c, task.Etag(), task.UpdatedAt) {
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+func postTasksHandler(c *gin.Context) {
+	user, exists := c.Get(gin.AuthUserKey)
+	if !exists {
+		log.Print("No user in POST /tasks/ handler context")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	c.JSON(http.StatusOK, tasks)
+	var task Task
+	if err := c.BindJSON(&task); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	// The creator isn't the client's to choose
+	task.UserID = user.(User).ID
+	createTask(c, user.(User), &task)
 }
 
-func getTasksIDHandler(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
+// createTask validates and inserts a task posted by user, and answers with its
+// location
+func createTask(c *gin.Context, user User, task *Task) {
+	if err := checkTaskDates(task.StartAt, task.DueAt); err != nil {
 		c.JSON(http.StatusBadRequest, err)
 		return
 	}
+	if task.Weight == 0 {
+		task.Weight = 1
+	}
+	if task.Weight < 0 {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "weight", Message: "must be a positive integer"})
+		return
+	}
+	if task.ParentID != nil {
+		var parent TaskResource
+		err := selectTaskWhereID.Get(&parent, *task.ParentID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusNotFound, nil)
+			return
+		}
+		if err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if _, ok := authorizeTask(c, user, &parent, taskEdit); !ok {
+			return
+		}
+		// Subtasks belong to the project of their parent by default
+		if task.ProjectID == nil {
+			task.ProjectID = parent.ProjectID
+		}
+	}
+	if task.ProjectID != nil {
+		err := checkAddToProject(*task.ProjectID, user)
+		if scopeErr, ok := err.(*ScopeError); ok {
+			denyScope(c, scopeErr)
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: "project_id", Message: err.Error()})
+			return
+		}
+	} else if _, ok := authorizeWorkspace(c, user, taskCreate); !ok {
+		return
+	}
+	if task.Status == "" {
+		task.Status = workflow.Initial
+	}
+	// The creator of a task is its owner
+	if err := workflow.CheckInitial(task.Status, []string{"owner"}); err != nil {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "status", Message: err.Error()})
+		return
+	}
 
-	var task TaskResource
-	err = selectTaskWhereID.Get(&task, id)
-	if err == sql.ErrNoRows {
-		c.JSON(http.StatusNotFound, nil)
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+	var taskID int
+	if err := tx.Stmtx(insertTask).Get(&taskID, task.Name, task.UserID, task.Description, task.Progression, task.Status, task.DueAt, task.StartAt, task.ParentID, task.Weight, task.ProjectID); err != nil {
+		log.Printf("couldn't insert to tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(insertTaskTransition).Exec(taskID, task.UserID, nil, task.Status); err != nil {
+		log.Printf("couldn't insert to task_transitions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ancestors, err := rollupProgression(tx, task.ParentID)
 	if err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var created TaskResource
+	if err := tx.Stmtx(selectTaskWhereID).Get(&created, taskID); err != nil {
 		log.Printf("couldn't select from tasks: %v", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	if err := audit(c, tx, "create", "/tasks/"+strconv.Itoa(taskID), nil, created, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := auditTasks(c, tx, ancestors); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
 
-	c.Header("Etag", task.Etag())
-	c.JSON(http.StatusOK, task)
+	c.Header("Location", "/tasks/"+strconv.Itoa(taskID))
+	c.Data(http.StatusCreated, "", nil)
 }
 
-func postTasksHandler(c *gin.Context) {
+func patchTasksIDHandler(c *gin.Context) {
 	user, exists := c.Get(gin.AuthUserKey)
 	if !exists {
-		log.Print("No user in POST /tasks/ handler context")
+		log.Print("No user in PATCH /tasks/:id handler context")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	var task = Task{UserID: user.(User).ID}
-	if err := c.BindJSON(&task); err != nil {
-		c.JSON(http.StatusBadRequest, err)
+	var task TaskResource
+	role, versions, ok := selectTaskIfMatch(c, user.(User), &task)
+	if !ok {
 		return
 	}
 
-	if _, err := insertTask.Exec(task.Name, task.UserID, task.Description, task.Progression); err != nil {
-		log.Printf("couldn't insert to tasks: %v", err)
+	// Apply patch document to the task, then validate the result
+	document, err := taskDocument(&task)
+	if err != nil {
+		log.Printf("couldn't build task document: %v", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
+	ctx := &taskPatchContext{task: &task, user: user.(User), roles: impliedRoles(role)}
+	var changes []taskChange
+	var applied interface{}
+	switch c.ContentType() {
+	case "application/json-patch+json":
+		var patch JSONPatch
+		if err = c.BindJSON(&patch); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		applied = patch
+		changes, err = patch.taskChanges(ctx, document)
+	case "application/merge-patch+json":
+		var patch interface{}
+		if err = c.BindJSON(&patch); err != nil {
+			c.AbortWithError(http.StatusBadRequest, err)
+			return
+		}
+		applied = patch
+		changes, err = taskChanges(ctx, document, mergePatch(document, patch))
+	default:
+		c.Header("Accept-Patch", acceptPatch)
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
 
-	c.Data(http.StatusCreated, "", nil)
+	updateTask(c, ctx, "update", versions, changes, applied)
 }
 
-// TaskPatches is a patch document according to https://tools.ietf.org/html/rfc6902
-// It only allows to replace the "name", "description" and "progression" fields
-type TaskPatches []struct {
-	Op    string      `json:"op" valid:"required,matches(replace)"`
-	Path  string      `json:"path" valid:"required,matches(^/name$|^/description$|^/progression$)"`
-	Value interface{} `json:"value" valid:"-"`
+// selectTaskIfMatch selects the task of the id param for user to edit it, and
+// returns their role on it and the versions of the If-Match header. The header
+// is required, so that the task isn't changed from a stale copy. It answers
+// and returns false otherwise
+func selectTaskIfMatch(c *gin.Context, user User, task *TaskResource) (string, pq.Int64Array, bool) {
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return "", nil, false
+	}
+
+	err = selectTaskWhereID.Get(task, taskID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return "", nil, false
+	}
+	if err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return "", nil, false
+	}
+	role, ok := authorizeTask(c, user, task, taskEdit)
+	if !ok {
+		return "", nil, false
+	}
+
+	ifMatch := c.Request.Header.Get("If-Match")
+	if ifMatch == "" {
+		c.AbortWithStatus(http.StatusConflict)
+		return "", nil, false
+	}
+	versions := parseIfMatch(ifMatch)
+	if !matchVersion(versions, task.Version) {
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return "", nil, false
+	}
+	return role, versions, true
 }
 
-func patchTasksIDHandler(c *gin.Context) {
+// updateTask stores the changes of the task of ctx, unless another request
+// updated it since it was selected, and records them in the audit log as an
+// action with the applied patch document
+func updateTask(c *gin.Context, ctx *taskPatchContext, action string, versions pq.Int64Array, changes []taskChange, applied interface{}) {
+	before := *ctx.task
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Stmtx(bumpTaskVersion).Exec(before.ID, versions)
+	if err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Another request updated the task since it was selected
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	if err := applyTaskChanges(tx, ctx, changes); err != nil {
+		if err, ok := err.(*FieldError); ok {
+			c.JSON(http.StatusBadRequest, err)
+			return
+		}
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var after TaskResource
+	if err := tx.Stmtx(selectTaskWhereID).Get(&after, before.ID); err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, action, "/tasks/"+strconv.Itoa(before.ID), before, after, applied); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := auditTasks(c, tx, ctx.changed); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+func deleteTasksIDHandler(c *gin.Context) {
 	user, exists := c.Get(gin.AuthUserKey)
 	if !exists {
-		log.Print("No user in PATCH /tasks/:id handler context")
+		log.Print("No user in DELETE /tasks/:id handler context")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -115,8 +406,7 @@ func patchTasksIDHandler(c *gin.Context) {
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-	if task.User.ID != user.(User).ID {
-		c.AbortWithStatus(http.StatusForbidden)
+	if _, ok := authorizeTask(c, user.(User), &task, taskEdit); !ok {
 		return
 	}
 
@@ -125,52 +415,111 @@ func patchTasksIDHandler(c *gin.Context) {
 		c.AbortWithStatus(http.StatusConflict)
 		return
 	}
-	if ifMatch != task.Etag() {
+	versions := parseIfMatch(ifMatch)
+	if !matchVersion(versions, task.Version) {
 		c.AbortWithStatus(http.StatusPreconditionFailed)
 		return
 	}
+	if task.Subtasks > 0 {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "subtasks", Message: "the subtasks must be deleted first"})
+		return
+	}
 
-	if c.ContentType() != "application/json-patch+json" {
-		c.Header("Accept-Patch", "application/json-patch+json")
-		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	result, err := tx.Stmtx(deleteTask).Exec(taskID, versions)
+	if err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		// Another request updated the task since it was selected
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	if _, err := tx.Stmtx(deleteCommentsWhereTaskID).Exec(taskID); err != nil {
+		log.Printf("couldn't update comments: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ancestors, err := rollupProgression(tx, task.ParentID)
+	if err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(bumpTaskVersionsWhereBlockerID).Exec(taskID); err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "delete", "/tasks/"+strconv.Itoa(taskID), task, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := auditTasks(c, tx, ancestors); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	var patches TaskPatches
-	if err = c.BindJSON(&patches); err != nil {
-		c.AbortWithError(http.StatusBadRequest, err)
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+func postTasksIDRestoreHandler(c *gin.Context) {
+	user, exists := c.Get(gin.AuthUserKey)
+	if !exists {
+		log.Print("No user in POST /tasks/:id/restore handler context")
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	// Validate patch document
-	for _, patch := range patches {
-		_, err := govalidator.ValidateStruct(patch)
-		if err != nil {
-			c.JSON(http.StatusBadRequest, err)
-			return
-		}
-		if patch.Value == nil {
-			c.JSON(http.StatusBadRequest, fmt.Errorf(`"value" can't be null`))
+	taskID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	var task TaskResource
+	err = selectDeletedTaskWhereID.Get(&task, taskID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, ok := authorizeTask(c, user.(User), &task, taskEdit); !ok {
+		return
+	}
+	if task.ParentID != nil {
+		var parent TaskResource
+		err := selectTaskWhereID.Get(&parent, *task.ParentID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: "parent_id", Message: "the parent must be restored first"})
 			return
 		}
-		switch patch.Value.(type) {
-		case float64:
-			if patch.Path != "/progression" {
-				c.JSON(http.StatusBadRequest, fmt.Errorf(`"value" doesn't have a correct type`))
-				return
-			}
-		case string:
-			if patch.Path != "/name" && patch.Path != "/description" {
-				c.JSON(http.StatusBadRequest, fmt.Errorf(`"value" doesn't have a correct type`))
-				return
-			}
-		default:
-			c.JSON(http.StatusBadRequest, fmt.Errorf(`"value" doesn't have a correct type`))
+		if err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
 	}
 
-	// Apply patch document
 	tx, err := db.Beginx()
 	if err != nil {
 		log.Printf("couldn't begin: %v", err)
@@ -178,27 +527,42 @@ func patchTasksIDHandler(c *gin.Context) {
 		return
 	}
 	defer tx.Rollback()
-	for _, patch := range patches {
-		switch patch.Path {
-		case "/name":
-			if _, err := tx.Stmtx(updateTasksName).Exec(patch.Value, taskID); err != nil {
-				log.Printf("couldn't update tasks: %v", err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
-		case "/description":
-			if _, err := tx.Stmtx(updateTasksDescription).Exec(patch.Value, taskID); err != nil {
-				log.Printf("couldn't update tasks: %v", err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
-		case "/progression":
-			if _, err := tx.Stmtx(updateTasksProgression).Exec(patch.Value, taskID); err != nil {
-				log.Printf("couldn't update tasks: %v", err)
-				c.AbortWithStatus(http.StatusInternalServerError)
-				return
-			}
-		}
+	if _, err := tx.Stmtx(restoreCommentsWhereTaskID).Exec(taskID, task.DeletedAt); err != nil {
+		log.Printf("couldn't update comments: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(restoreTask).Exec(taskID); err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ancestors, err := rollupProgression(tx, task.ParentID)
+	if err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(bumpTaskVersionsWhereBlockerID).Exec(taskID); err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var restored TaskResource
+	if err := tx.Stmtx(selectTaskWhereID).Get(&restored, taskID); err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "restore", "/tasks/"+strconv.Itoa(taskID), task, restored, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := auditTasks(c, tx, ancestors); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
 	}
 	if err := tx.Commit(); err != nil {
 		log.Printf("couldn't commit: %v", err)
@@ -209,6 +573,20 @@ func patchTasksIDHandler(c *gin.Context) {
 	c.Data(http.StatusNoContent, "", nil)
 }
 
+func getTrashHandler(c *gin.Context) {
+	user, exists := c.Get(gin.AuthUserKey)
+	if !exists {
+		log.Print("No user in GET /trash handler context")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	listTasks(c, func(query *taskQuery) {
+		query.deleted = true
+		query.Where("tasks.user_id = ?", user.(User).ID)
+	})
+}
+
 func getUsersIDTasksHandler(c *gin.Context) {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -216,14 +594,9 @@ func getUsersIDTasksHandler(c *gin.Context) {
 		return
 	}
 
-	var tasks []TaskResource
-	if err = selectTasksWhereUserID.Select(&tasks, id); err != nil {
-		log.Printf("couldn't select from tasks: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
-	}
-
-	c.JSON(http.StatusOK, tasks)
+	listTasks(c, func(query *taskQuery) {
+		query.Where("tasks.user_id = ?", id)
+	})
 }
 
 func postTasksIDCommentsHandler(c *gin.Context) {
@@ -234,32 +607,40 @@ func postTasksIDCommentsHandler(c *gin.Context) {
 		return
 	}
 
-	taskID, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		c.JSON(http.StatusBadRequest, err)
+	var task TaskResource
+	if _, ok := selectAuthorizedTask(c, &task, taskComment); !ok {
 		return
 	}
 
-	var task TaskResource
-	err = selectTaskWhereID.Get(&task, taskID)
-	if err == sql.ErrNoRows {
-		c.AbortWithStatus(http.StatusNotFound)
+	var comment Comment
+	if err := c.BindJSON(&comment); err != nil {
+		c.JSON(http.StatusBadRequest, err)
 		return
 	}
+	// Neither the author nor the task are the client's to choose
+	comment.UserID, comment.TaskID = user.(User).ID, task.ID
+
+	tx, err := db.Beginx()
 	if err != nil {
-		log.Printf("couldn't select from tasks: %v:", err)
+		log.Printf("couldn't begin: %v", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-
-	var comment = Comment{UserID: user.(User).ID, TaskID: taskID}
-	if err := c.BindJSON(&comment); err != nil {
-		c.JSON(http.StatusBadRequest, err)
+	defer tx.Rollback()
+	if err := tx.Stmtx(insertComment).Get(&comment.ID, comment.UserID, comment.TaskID, comment.Content); err != nil {
+		log.Printf("couldn't insert to comments: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
-
-	if _, err := insertComment.Exec(comment.UserID, comment.TaskID, comment.Content); err != nil {
-		log.Printf("couldn't insert to comments: %v", err)
+	resource := "/tasks/" + strconv.Itoa(task.ID) + "/comments/" + strconv.Itoa(comment.ID)
+	after := gin.H{"id": comment.ID, "task_id": comment.TaskID, "user_id": comment.UserID, "content": comment.Content}
+	if err := audit(c, tx, "create", resource, nil, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
@@ -268,12 +649,41 @@ func postTasksIDCommentsHandler(c *gin.Context) {
 }
 
 func getTasksIDCommentsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
 	taskID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, err)
 		return
 	}
 
+	// A task that doesn't exist has no comments
+	var task TaskResource
+	err = selectTaskWhereID.Get(&task, taskID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err == nil {
+		if _, ok := authorizeTask(c, user, &task, taskView); !ok {
+			return
+		}
+	}
+
+	var validators collectionValidators
+	if err := selectCommentValidatorsWhereTaskID.Get(&validators, taskID); err != nil {
+		log.Printf("couldn't select from comments: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if notModified(c, validators.Etag(c), validators.LastModified.Time) {
+		return
+	}
+
 	var comments []CommentResource
 	if err = selectCommentsWhereTaskID.Select(&comments, taskID); err != nil {
 		log.Printf("couldn't select from comments: %v", err)
@@ -284,13 +694,53 @@ func getTasksIDCommentsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, comments)
 }
 
+func getTasksIDTransitionsHandler(c *gin.Context) {
+	var task TaskResource
+	if _, ok := selectAuthorizedTask(c, &task, taskView); !ok {
+		return
+	}
+
+	var transitions []TransitionResource
+	if err := selectTransitionsWhereTaskID.Select(&transitions, task.ID); err != nil {
+		log.Printf("couldn't select from task_transitions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, transitions)
+}
+
+func getWorkflowHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, workflow)
+}
+
+// getUsersIDCommentsHandler lists the comments of a user on every task, so it
+// requires the permission to view every task
 func getUsersIDCommentsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, workspaceView); !ok {
+		return
+	}
+
 	userID, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, err)
 		return
 	}
 
+	var validators collectionValidators
+	if err := selectCommentValidatorsWhereUserID.Get(&validators, userID); err != nil {
+		log.Printf("couldn't select from comments: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if notModified(c, validators.Etag(c), validators.LastModified.Time) {
+		return
+	}
+
 	var comments []CommentResource
 	if err := selectCommentsWhereUserID.Select(&comments, userID); err != nil {
 		log.Printf("couldn't select from tasks: %v", err)
@@ -301,27 +751,56 @@ func getUsersIDCommentsHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, comments)
 }
 
-func authMiddleware(c *gin.Context) {
-	header := c.Request.Header.Get("Authorization")
-	fields := strings.Fields(header)
-	if len(fields) != 2 || fields[0] != "Token" {
-		c.Header("WWW-Authenticate", "Token")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
+// authMiddleware returns a middleware that authenticates the user of a token,
+// and checks that the token has scope. It accepts API tokens with the Token
+// scheme, and OAuth access tokens with the Bearer scheme. Without an
+// Authorization header, it accepts the session cookie of a browser, which
+// grants every scope. Failed tokens are throttled, see authAttempt
+func authMiddleware(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.Request.Header.Get("Authorization")
+		if header == "" {
+			if s, ok := authenticateSession(c); ok {
+				c.Set(gin.AuthUserKey, s.User)
+			}
+			return
+		}
+		fields := strings.Fields(header)
+		if len(fields) != 2 || fields[0] != "Token" && fields[0] != "Bearer" {
+			challenge(c)
+			return
+		}
 
-	var user User
-	err := selectUsersWhereToken.Get(&user, fields[1])
-	if err == sql.ErrNoRows {
-		c.Header("WWW-Authenticate", "Token")
-		c.AbortWithStatus(http.StatusUnauthorized)
-		return
-	}
-	if err != nil {
-		log.Printf("couldn't select from users: %v", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
-		return
+		attempt := newAuthAttempt(c, "token", fields[1], true)
+		locked, failed := attempt.locked(c)
+		if locked {
+			return
+		}
+		user, err := selectTokenUser(fields[1], fields[0] == "Bearer")
+		if err == sql.ErrNoRows {
+			attempt.fail("unknown, revoked or expired token")
+			challenge(c)
+			return
+		}
+		if err != nil {
+			log.Printf("couldn't select from api_tokens: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if failed {
+			attempt.succeed()
+		}
+
+		if !authorizeScope(c, user, scope) {
+			return
+		}
+		c.Set(gin.AuthUserKey, user)
 	}
+}
 
-	c.Set(gin.AuthUserKey, user)
+// challenge answers 401 Unauthorized with the accepted authentication schemes
+func challenge(c *gin.Context) {
+	c.Writer.Header().Add("WWW-Authenticate", "Token")
+	c.Writer.Header().Add("WWW-Authenticate", "Bearer")
+	c.AbortWithStatus(http.StatusUnauthorized)
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"time"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// diffDocuments returns the changes between two JSON objects, sorted by field.
+// A nil object has no fields. updated_at is left out, because it changes with
+// every revision
+func diffDocuments(before, after *json.RawMessage) ([]FieldChange, error) {
+	objects := make([]map[string]interface{}, 2)
+	fields := map[string]bool{}
+	for i, document := range []*json.RawMessage{before, after} {
+		objects[i] = map[string]interface{}{}
+		if document == nil {
+			continue
+		}
+		if err := json.Unmarshal(*document, &objects[i]); err != nil {
+			return nil, err
+		}
+		for field := range objects[i] {
+			fields[field] = true
+		}
+	}
+	delete(fields, "updated_at")
+
+	var names []string
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, field := range names {
+		if !reflect.DeepEqual(objects[0][field], objects[1][field]) {
+			changes = append(changes, FieldChange{Field: field, Before: objects[0][field], After: objects[1][field]})
+		}
+	}
+	return changes, nil
+}
+
+// getTasksIDHistoryHandler answers the revisions of a task, newest first, with
+// their diffs. They are paginated like tasks, with limit and cursor
+func getTasksIDHistoryHandler(c *gin.Context) {
+	var task TaskResource
+	if _, ok := selectAuthorizedTask(c, &task, taskView); !ok {
+		return
+	}
+
+	limit := defaultLimit
+	if v, ok := c.GetQuery("limit"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			c.JSON(http.StatusBadRequest, &ParamError{"limit", fmt.Sprintf("must be an integer between 1 and %d", maxLimit)})
+			return
+		}
+		limit = n
+	}
+	before := cursor{Value: "infinity", ID: math.MaxInt32}
+	if v, ok := c.GetQuery("cursor"); ok {
+		cur, err := parseCursor(v)
+		if err != nil || cur.Sort != "-created_at" {
+			c.JSON(http.StatusBadRequest, &ParamError{"cursor", "malformed cursor"})
+			return
+		}
+		if _, err := time.Parse(time.RFC3339Nano, cur.Value); err != nil {
+			c.JSON(http.StatusBadRequest, &ParamError{"cursor", "malformed cursor"})
+			return
+		}
+		before = cur
+	}
+
+	revisions := []TaskRevisionResource{}
+	if err := selectTaskRevisions.Select(&revisions, "/tasks/"+strconv.Itoa(task.ID), before.Value, before.ID, limit+1); err != nil {
+		log.Printf("couldn't select from audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var next *cursor
+	if len(revisions) > limit {
+		revisions = revisions[:limit]
+		last := revisions[limit-1]
+		next = &cursor{Sort: "-created_at", Value: formatTime(last.CreatedAt), ID: last.ID}
+	}
+	for i := range revisions {
+		changes, err := diffDocuments(revisions[i].Before, revisions[i].After)
+		if err != nil {
+			log.Printf("couldn't diff revision %d: %v", revisions[i].ID, err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		revisions[i].Changes = changes
+	}
+
+	setLinkHeader(c, next)
+	c.JSON(http.StatusOK, revisions)
+}
+
+// answerTaskAsOf answers a task as its latest revision at the date asOf
+// recorded it. It answers 404 if the task didn't exist then, or was deleted
+func answerTaskAsOf(c *gin.Context, taskID int, asOf string) {
+	t, err := time.Parse(time.RFC3339Nano, asOf)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &ParamError{"as_of", "must be a RFC 3339 date"})
+		return
+	}
+
+	var snapshot *json.RawMessage
+	err = selectTaskRevisionAsOf.Get(&snapshot, "/tasks/"+strconv.Itoa(taskID), t)
+	if err == sql.ErrNoRows || err == nil && snapshot == nil {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't select from audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var task TaskResource
+	if err := json.Unmarshal(*snapshot, &task); err != nil {
+		log.Printf("couldn't unmarshal a revision of task %d: %v", taskID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Past versions have no Etag, because they can't be patched
+	c.JSON(http.StatusOK, task)
+}
+
+// postTasksIDRevertHandler reverts the patchable fields of a task to a
+// revision. The changes are validated and stored like those of a merge patch,
+// and the If-Match header is required likewise
+func postTasksIDRevertHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var task TaskResource
+	role, versions, ok := selectTaskIfMatch(c, user, &task)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Revision int `json:"revision" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	var snapshot *json.RawMessage
+	err := selectTaskRevisionWhereID.Get(&snapshot, body.Revision, "/tasks/"+strconv.Itoa(task.ID))
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "revision", Message: "must be a revision of the task"})
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't select from audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if snapshot == nil {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "revision", Message: "the task was deleted by this revision"})
+		return
+	}
+	var revision TaskResource
+	if err := json.Unmarshal(*snapshot, &revision); err != nil {
+		log.Printf("couldn't unmarshal a revision of task %d: %v", task.ID, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	document, err := taskDocument(&task)
+	if err != nil {
+		log.Printf("couldn't build task document: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	reverted, err := taskDocument(&revision)
+	if err != nil {
+		log.Printf("couldn't build task document: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	// The merge patch that reverts the patchable fields. The progression of
+	// tasks with subtasks is derived from them, so it is left as it is
+	patch := map[string]interface{}{}
+	for field := range taskFields {
+		if field == "progression" && task.Subtasks > 0 {
+			continue
+		}
+		if !reflect.DeepEqual(document[field], reverted[field]) {
+			patch[field] = reverted[field]
+		}
+	}
+	ctx := &taskPatchContext{task: &task, user: user, roles: impliedRoles(role)}
+	changes, err := taskChanges(ctx, document, mergePatch(document, patch))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	updateTask(c, ctx, "revert", versions, changes, patch)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// JSONPatch is a patch document according to https://tools.ietf.org/html/rfc6902
+// It applies to documents decoded by encoding/json in an interface{}
+type JSONPatch []PatchOperation
+
+// PatchOperation is a single operation of a JSONPatch
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+
+	// hasValue tells a null value from a missing one
+	hasValue bool
+}
+
+// UnmarshalJSON decodes an operation and records whether it has a value
+func (op *PatchOperation) UnmarshalJSON(b []byte) error {
+	type operation PatchOperation
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(b, &members); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, (*operation)(op)); err != nil {
+		return err
+	}
+	_, op.hasValue = members["value"]
+	return nil
+}
+
+// PatchError locates the operation of a JSONPatch that failed
+type PatchError struct {
+	Index   int    `json:"index"`
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (e *PatchError) Error() string {
+	return fmt.Sprintf("operation %d (%s %s): %s", e.Index, e.Op, e.Path, e.Message)
+}
+
+// Apply applies the patch to a copy of doc and returns it. Either every
+// operation succeeds or doc is left as is and a *PatchError is returned
+func (patch JSONPatch) Apply(doc interface{}) (interface{}, error) {
+	doc = deepCopy(doc)
+	for i, op := range patch {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			return nil, &PatchError{Index: i, Op: op.Op, Path: op.Path, Message: err.Error()}
+		}
+	}
+	return doc, nil
+}
+
+// LastIndexTouching returns the index of the last operation that writes at or
+// under path, or -1
+func (patch JSONPatch) LastIndexTouching(path string) int {
+	under := func(p string) bool { return p == path || strings.HasPrefix(p, path+"/") }
+	for i := len(patch) - 1; i >= 0; i-- {
+		op := patch[i]
+		if op.Op != "test" && under(op.Path) || op.Op == "move" && under(op.From) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (op *PatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if !op.hasValue {
+			return nil, fmt.Errorf(`missing "value"`)
+		}
+	case "move", "copy":
+		if _, err := parsePointer(op.From); err != nil {
+			return nil, fmt.Errorf(`invalid "from": %v`, err)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addValue(doc, path, deepCopy(op.Value))
+	case "remove":
+		doc, _, err := removeValue(doc, path)
+		return doc, err
+	case "replace":
+		if len(path) == 0 {
+			return deepCopy(op.Value), nil
+		}
+		doc, _, err := removeValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return addValue(doc, path, deepCopy(op.Value))
+	case "move":
+		from, _ := parsePointer(op.From)
+		if op.Path != op.From && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf(`"from" can't be a parent of "path"`)
+		}
+		doc, value, err := removeValue(doc, from)
+		if err != nil {
+			return nil, fmt.Errorf(`"from": %v`, err)
+		}
+		return addValue(doc, path, value)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		value, err := getValue(doc, from)
+		if err != nil {
+			return nil, fmt.Errorf(`"from": %v`, err)
+		}
+		return addValue(doc, path, deepCopy(value))
+	case "test":
+		value, err := getValue(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(value, op.Value) {
+			return nil, fmt.Errorf("test failed")
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// parsePointer splits a JSON pointer into its reference tokens, see
+// https://tools.ietf.org/html/rfc6901
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("pointer %q must start with a /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+// arrayIndex parses token as an index in an array of length n. The index n
+// itself (or "-") is only valid when allowEnd is set
+func arrayIndex(token string, n int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return n, nil
+	}
+	if token == "" || len(token) > 1 && token[0] == '0' {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > n || i == n && !allowEnd {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+func getValue(doc interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q doesn't exist", token)
+			}
+			doc = value
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, fmt.Errorf("can't reference %q in a scalar value", token)
+		}
+	}
+	return doc, nil
+}
+
+// update replaces the container that holds the last token of path with the one
+// returned by fn, and returns the updated document
+func update(doc interface{}, path []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return fn(doc, path[0])
+	}
+	child, err := getValue(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = update(child, path[1:], fn)
+	if err != nil {
+		return nil, err
+	}
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(node), false)
+		node[i] = child
+	}
+	return doc, nil
+}
+
+func addValue(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), true)
+			if err != nil {
+				return nil, err
+			}
+			node = append(node, nil)
+			copy(node[i+1:], node[i:])
+			node[i] = value
+			return node, nil
+		}
+		return nil, fmt.Errorf("can't add %q to a scalar value", token)
+	})
+}
+
+func removeValue(doc interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("can't remove the whole document")
+	}
+	var removed interface{}
+	doc, err := update(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch node := container.(type) {
+		case map[string]interface{}:
+			value, ok := node[token]
+			if !ok {
+				return nil, fmt.Errorf("member %q doesn't exist", token)
+			}
+			removed = value
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(node), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = node[i]
+			return append(node[:i], node[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("can't remove %q from a scalar value", token)
+	})
+	return doc, removed, err
+}
+
+// deepCopy copies a document decoded by encoding/json
+func deepCopy(doc interface{}) interface{} {
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(node))
+		for k, v := range node {
+			m[k] = deepCopy(v)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(node))
+		for i, v := range node {
+			a[i] = deepCopy(v)
+		}
+		return a
+	}
+	return doc
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Examples from https://tools.ietf.org/html/rfc6902#appendix-A
+var jsonPatchTests = []struct {
+	doc, patch, expected string
+	errIndex             int
+}{
+	{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`, -1},
+	{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`, -1},
+	{`{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`, -1},
+	{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`, -1},
+	{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`, -1},
+	{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`, -1},
+	{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`, -1},
+	{`{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2}]`, `{"baz":"qux","foo":["a",2,"c"]}`, -1},
+	{`{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`, ``, 0},
+	{`{"foo":"bar"}`, `[{"op":"add","path":"/child","value":{"grandchild":{}}}]`, `{"foo":"bar","child":{"grandchild":{}}}`, -1},
+	{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`, ``, 0},
+	{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":["abc","def"]}]`, `{"foo":["bar",["abc","def"]]}`, -1},
+	{`{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10}]`, `{"/":9,"~1":10}`, -1},
+	{`{"foo":null}`, `[{"op":"test","path":"/foo","value":null}]`, `{"foo":null}`, -1},
+	{`{"foo":1}`, `[{"op":"copy","from":"/foo","path":"/bar"}]`, `{"foo":1,"bar":1}`, -1},
+	{`{"foo":1}`, `[{"op":"replace","path":"/foo","value":2},{"op":"remove","path":"/bar"}]`, ``, 1},
+	{`{"foo":[1]}`, `[{"op":"add","path":"/foo/01","value":2}]`, ``, 0},
+	{`{"foo":[1]}`, `[{"op":"add","path":"/foo/2","value":2}]`, ``, 0},
+	{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, ``, 0},
+	{`{"foo":1}`, `[{"op":"add","path":"/bar"}]`, ``, 0},
+	{`{"foo":1}`, `[{"op":"qwerty","path":"/foo"}]`, ``, 0},
+	{`{"foo":1}`, `[{"op":"add","path":"foo","value":2}]`, ``, 0},
+}
+
+func TestJSONPatchApply(t *testing.T) {
+	for _, test := range jsonPatchTests {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(test.doc), &doc); err != nil {
+			t.Fatalf("couldn't decode %s: %v", test.doc, err)
+		}
+		var patch JSONPatch
+		if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+			t.Fatalf("couldn't decode %s: %v", test.patch, err)
+		}
+
+		patched, err := patch.Apply(doc)
+		if test.errIndex >= 0 {
+			patchErr, ok := err.(*PatchError)
+			if !ok {
+				t.Errorf("%s: expected a *PatchError; got %v", test.patch, err)
+				continue
+			}
+			if patchErr.Index != test.errIndex {
+				t.Errorf("%s: expected error at index %d; got %d", test.patch, test.errIndex, patchErr.Index)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.patch, err)
+			continue
+		}
+
+		var expected interface{}
+		json.Unmarshal([]byte(test.expected), &expected)
+		if !reflect.DeepEqual(patched, expected) {
+			t.Errorf("%s: expected %v; got %v", test.patch, expected, patched)
+		}
+	}
+}
+
+func TestJSONPatchApplyIsAtomic(t *testing.T) {
+	doc := map[string]interface{}{"foo": "bar"}
+	var patch JSONPatch
+	json.Unmarshal([]byte(`[{"op":"replace","path":"/foo","value":"baz"},{"op":"test","path":"/foo","value":"bar"}]`), &patch)
+
+	if _, err := patch.Apply(doc); err == nil {
+		t.Fatal("expected test operation to fail")
+	}
+	if doc["foo"] != "bar" {
+		t.Errorf("expected document to be left as is; got %v", doc)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// defaultLabelColor is the color of the labels posted without one
+const defaultLabelColor = "#ededed"
+
+var labelColorRegexp = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// checkLabel returns a *FieldError if a label is invalid. Names can't hold
+// commas, which separate labels in the label query string parameter
+func checkLabel(label *Label) error {
+	if label.Name == "" || strings.Contains(label.Name, ",") {
+		return &FieldError{Field: "name", Message: "must be a non-empty string without commas"}
+	}
+	if !labelColorRegexp.MatchString(label.Color) {
+		return &FieldError{Field: "color", Message: "must be an hexadecimal color, like #ff0000"}
+	}
+	return nil
+}
+
+// isUniqueViolation tells whether err is a violated unique constraint
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func getLabelsHandler(c *gin.Context) {
+	var labels []LabelResource
+	if err := selectLabels.Select(&labels); err != nil {
+		log.Printf("couldn't select from labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, labels)
+}
+
+func getLabelsIDHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	var label LabelResource
+	err = selectLabelWhereID.Get(&label, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't select from labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, label)
+}
+
+func postLabelsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, labelManage); !ok {
+		return
+	}
+
+	var label Label
+	if err := c.BindJSON(&label); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if label.Color == "" {
+		label.Color = defaultLabelColor
+	}
+	if err := checkLabel(&label); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var labelID int
+	err = tx.Stmtx(insertLabel).Get(&labelID, label.Name, label.Color, label.Description)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, &FieldError{Field: "name", Message: "already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't insert to labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var created LabelResource
+	if err := tx.Stmtx(selectLabelWhereID).Get(&created, labelID); err != nil {
+		log.Printf("couldn't select from labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "create", "/labels/"+strconv.Itoa(labelID), nil, created, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", "/labels/"+strconv.Itoa(labelID))
+	c.Data(http.StatusCreated, "", nil)
+}
+
+// patchLabelsIDHandler applies a JSON Merge Patch to a label. Renaming a label
+// renames it on every task
+func patchLabelsIDHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, labelManage); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	var label LabelResource
+	err = selectLabelWhereID.Get(&label, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't select from labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var changed Label
+	if !bindMergePatch(c, &label, []string{"name", "color", "description"}, &changed) {
+		return
+	}
+	if err := checkLabel(&changed); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	// The tasks that have the label are selected before its update, and their
+	// changes are recorded after every write, see taskEventsLockID
+	var tasks []TaskResource
+	if changed.Name != label.Name {
+		if err := tx.Stmtx(selectTasksWhereLabelID).Select(&tasks, id); err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	_, err = tx.Stmtx(updateLabel).Exec(changed.Name, changed.Color, changed.Description, id)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, &FieldError{Field: "name", Message: "already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't update labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if changed.Name != label.Name {
+		if _, err := tx.Stmtx(bumpTaskVersionsWhereLabelID).Exec(id); err != nil {
+			log.Printf("couldn't update tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	var after LabelResource
+	if err := tx.Stmtx(selectLabelWhereID).Get(&after, id); err != nil {
+		log.Printf("couldn't select from labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "update", "/labels/"+strconv.Itoa(id), label, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := auditTasks(c, tx, tasks); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// deleteLabelsIDHandler deletes a label and removes it from every task
+func deleteLabelsIDHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, labelManage); !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var label LabelResource
+	err = tx.Stmtx(selectLabelWhereID).Get(&label, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't select from labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var tasks []TaskResource
+	if err := tx.Stmtx(selectTasksWhereLabelID).Select(&tasks, id); err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(bumpTaskVersionsWhereLabelID).Exec(id); err != nil {
+		log.Printf("couldn't update tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(deleteLabel).Exec(id); err != nil {
+		log.Printf("couldn't delete from labels: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "delete", "/labels/"+strconv.Itoa(id), label, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := auditTasks(c, tx, tasks); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
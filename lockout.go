@@ -0,0 +1,190 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// authFailureWindow is how long authentication failures are remembered
+var authFailureWindow = 15 * time.Minute
+
+// authFailureLimit is how many times a credential can fail to authenticate in
+// the window before it is locked
+var authFailureLimit = 5
+
+// authIPFailureLimit is how many times an IP can fail to authenticate in the
+// window before it is locked. It is higher than authFailureLimit, because many
+// users can share an IP
+var authIPFailureLimit = 50
+
+// authLockoutBase is how long a key is locked when it reaches its limit. It
+// doubles with each failure after that, up to authLockoutMax
+const (
+	authLockoutBase = time.Minute
+	authLockoutMax  = time.Hour
+)
+
+// trustProxy tells whether the task manager runs behind a proxy, such as the
+// Heroku router, that appends the IP of its clients to the X-Forwarded-For
+// header. It is set by the TRUST_PROXY env
+var trustProxy = false
+
+// clientIP returns the IP of the client of a request. Unlike c.ClientIP, it
+// ignores the X-Forwarded-For and X-Real-Ip headers sent by clients, which
+// would let them pick an IP for each attempt
+func clientIP(c *gin.Context) string {
+	if trustProxy {
+		if forwarded := c.Request.Header.Get("X-Forwarded-For"); forwarded != "" {
+			ips := strings.Split(forwarded, ",")
+			return strings.TrimSpace(ips[len(ips)-1])
+		}
+	}
+	host, _, err := net.SplitHostPort(c.Request.RemoteAddr)
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return host
+}
+
+// AuthEvent is a security event about an authentication attempt
+type AuthEvent struct {
+	IP          string     `json:"ip"`
+	Kind        string     `json:"kind"`
+	Credential  string     `json:"credential"`
+	Reason      string     `json:"reason,omitempty"`
+	Failures    int        `json:"failures,omitempty"`
+	LockedUntil *time.Time `json:"locked_until,omitempty"`
+}
+
+// authAttempt is an attempt to authenticate with a credential of a kind, e.g.
+// a token or a username. Attempts are throttled both by the IP of the client
+// and by the credential, so that neither guessing many credentials from an IP
+// nor guessing one credential from many IPs works. Failures are stored in
+// Postgres, so that every instance throttles them alike
+type authAttempt struct {
+	ip         string
+	kind       string
+	credential string
+	// label identifies the credential in the security events
+	label string
+}
+
+// newAuthAttempt returns an attempt of the client of c. Secret credentials are
+// hashed before being stored or logged
+func newAuthAttempt(c *gin.Context, kind, credential string, secret bool) authAttempt {
+	label := credential
+	if secret {
+		credential = hashToken(credential)
+		label = credential[:8]
+	}
+	return authAttempt{ip: clientIP(c), kind: kind, credential: credential, label: label}
+}
+
+func (a authAttempt) ipKey() string {
+	return "ip:" + a.ip
+}
+
+func (a authAttempt) credentialKey() string {
+	return a.kind + ":" + a.credential
+}
+
+// event logs a security event about the attempt
+func (a authAttempt) event(eventType, reason string, failures int, lockedUntil *time.Time) {
+	event := Event{Type: eventType, Time: time.Now(), Data: AuthEvent{
+		IP:          a.ip,
+		Kind:        a.kind,
+		Credential:  a.label,
+		Reason:      reason,
+		Failures:    failures,
+		LockedUntil: lockedUntil,
+	}}
+	if err := (logSink{}).Send(event); err != nil {
+		log.Printf("couldn't log a security event: %v", err)
+	}
+}
+
+// locked answers 429 Too Many Requests and returns true if the IP or the
+// credential of the attempt is locked. It is checked before the credential,
+// so that a locked credential can't be confirmed. It also returns whether the
+// credential has failures, which succeed must then forget
+func (a authAttempt) locked(c *gin.Context) (locked, failed bool) {
+	var lock struct {
+		Until  *time.Time `db:"locked_until"`
+		Failed bool
+	}
+	if err := selectAuthLock.Get(&lock, pq.Array([]string{a.ipKey(), a.credentialKey()}), a.credentialKey()); err != nil {
+		log.Printf("couldn't select from auth_failures: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return true, false
+	}
+	if lock.Until == nil {
+		return false, lock.Failed
+	}
+
+	a.event("auth.locked", "", 0, lock.Until)
+	c.Header("Retry-After", strconv.Itoa(int(time.Until(*lock.Until).Seconds())+1))
+	c.AbortWithStatus(http.StatusTooManyRequests)
+	return true, lock.Failed
+}
+
+// fail counts a failure of the attempt, for its IP and for its credential, and
+// locks those that reach their limit
+func (a authAttempt) fail(reason string) {
+	failures := 0
+	for _, limit := range []struct {
+		key   string
+		limit int
+	}{{a.credentialKey(), authFailureLimit}, {a.ipKey(), authIPFailureLimit}} {
+		var n int
+		if err := insertAuthFailure.Get(&n, limit.key, int(authFailureWindow.Seconds())); err != nil {
+			log.Printf("couldn't insert to auth_failures: %v", err)
+			continue
+		}
+		if limit.key == a.credentialKey() {
+			failures = n
+		}
+		if n < limit.limit {
+			continue
+		}
+		lockout := authLockoutMax
+		if n-limit.limit < 16 {
+			if d := authLockoutBase << uint(n-limit.limit); d < lockout {
+				lockout = d
+			}
+		}
+		var until time.Time
+		if err := lockAuthKey.Get(&until, limit.key, int(lockout.Seconds())); err != nil {
+			log.Printf("couldn't update auth_failures: %v", err)
+			continue
+		}
+		a.event("auth.lockout", strings.SplitN(limit.key, ":", 2)[0]+" reached its limit", n, &until)
+	}
+	a.event("auth.failure", reason, failures, nil)
+}
+
+// succeed forgets the failures of the credential of the attempt, if locked
+// found any. The failures of the IP are kept, so that a valid credential can't
+// reset them
+func (a authAttempt) succeed() {
+	if _, err := deleteAuthFailures.Exec(a.credentialKey()); err != nil {
+		log.Printf("couldn't delete from auth_failures: %v", err)
+	}
+}
+
+// purgeAuthFailuresEvery deletes the failures that are out of the window
+// periodically. It never returns
+func purgeAuthFailuresEvery(interval time.Duration) {
+	for {
+		if _, err := deleteStaleAuthFailures.Exec(int(authFailureWindow.Seconds())); err != nil {
+			log.Printf("couldn't purge auth_failures: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"gopkg.in/gin-gonic/gin.v1"
@@ -26,13 +28,97 @@ func main() {
 	}
 	db = sqlx.MustConnect("postgres", databaseURL)
 
-	if *seedFlag {
-		create()
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrate(os.Stdout, flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	workflowFile := os.Getenv("WORKFLOW_FILE")
+	if workflowFile == "" {
+		workflowFile = "workflow.yml"
+	}
+	var err error
+	workflow, err = loadWorkflow(workflowFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := migrateUp(); err != nil {
+		log.Fatal(err)
 	}
 	prepare()
 	if *seedFlag {
 		seed()
 	}
 
+	retention := 30 * 24 * time.Hour
+	if v := os.Getenv("TRASH_RETENTION"); v != "" {
+		if retention, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid TRASH_RETENTION: %v", err)
+		}
+	}
+	go purgeTrashEvery(time.Hour, retention)
+
+	lead := time.Hour
+	if v := os.Getenv("REMINDER_LEAD"); v != "" {
+		if lead, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid REMINDER_LEAD: %v", err)
+		}
+	}
+	sinks := []EventSink{logSink{}}
+	if url := os.Getenv("REMINDER_HOOK_URL"); url != "" {
+		sinks = append(sinks, newHookSink(url))
+	}
+	go sendRemindersEvery(time.Minute, lead, sinks)
+
+	if v := os.Getenv("SIGNUP_MODE"); v != "" {
+		if v != "admin" && v != "open" {
+			log.Fatalf("invalid SIGNUP_MODE %q: must be admin or open", v)
+		}
+		signupMode = v
+	}
+	if v := os.Getenv("TOKEN_ROTATION_GRACE"); v != "" {
+		grace, err := time.ParseDuration(v)
+		if err != nil || grace < 0 {
+			log.Fatalf("invalid TOKEN_ROTATION_GRACE %q: must be a positive duration, e.g. 24h", v)
+		}
+		tokenRotationGrace = grace
+	}
+	if v := os.Getenv("SESSION_TTL"); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if err != nil || ttl <= 0 {
+			log.Fatalf("invalid SESSION_TTL %q: must be a positive duration, e.g. 168h", v)
+		}
+		sessionTTL = ttl
+	}
+	if v := os.Getenv("SESSION_COOKIE_SECURE"); v != "" {
+		if secureCookies, err = strconv.ParseBool(v); err != nil {
+			log.Fatalf("invalid SESSION_COOKIE_SECURE: %v", err)
+		}
+	}
+	go purgeSessionsEvery(time.Hour)
+	if v := os.Getenv("TRUST_PROXY"); v != "" {
+		if trustProxy, err = strconv.ParseBool(v); err != nil {
+			log.Fatalf("invalid TRUST_PROXY: %v", err)
+		}
+	}
+	go purgeAuthFailuresEvery(time.Hour)
+	if v := os.Getenv("EVENT_RETENTION"); v != "" {
+		if taskEventRetention, err = time.ParseDuration(v); err != nil {
+			log.Fatalf("invalid EVENT_RETENTION: %v", err)
+		}
+	}
+	go purgeTaskEventsEvery(time.Hour)
+	go purgeTaskViewersEvery(time.Minute)
+	go listenTaskEvents(databaseURL)
+	if v := os.Getenv("WEBHOOK_ALLOW_INTERNAL"); v != "" {
+		if webhookAllowInternal, err = strconv.ParseBool(v); err != nil {
+			log.Fatalf("invalid WEBHOOK_ALLOW_INTERNAL: %v", err)
+		}
+	}
+	go deliverWebhooksEvery(time.Minute)
+
 	log.Fatal(router.Run())
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// mergePatch applies a merge patch document to a copy of target and returns
+// it, according to https://tools.ietf.org/html/rfc7396
+func mergePatch(target, patch interface{}) interface{} {
+	object, ok := patch.(map[string]interface{})
+	if !ok {
+		return deepCopy(patch)
+	}
+	merged, ok := deepCopy(target).(map[string]interface{})
+	if !ok {
+		merged = make(map[string]interface{})
+	}
+	for name, value := range object {
+		if value == nil {
+			delete(merged, name)
+			continue
+		}
+		merged[name] = mergePatch(merged[name], value)
+	}
+	return merged
+}
+
+// bindMergePatch applies the merge patch of the request to resource, and binds
+// the patched document to model. Only the writable fields of the resource can
+// change. It answers and returns false if the patch is invalid
+func bindMergePatch(c *gin.Context, resource interface{}, writable []string, model interface{}) bool {
+	if c.ContentType() != "application/merge-patch+json" {
+		c.Header("Accept-Patch", "application/merge-patch+json")
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return false
+	}
+	var patch interface{}
+	if err := c.BindJSON(&patch); err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return false
+	}
+
+	b, err := json.Marshal(resource)
+	if err != nil {
+		log.Printf("couldn't build document: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	var document map[string]interface{}
+	json.Unmarshal(b, &document)
+	patched, ok := mergePatch(document, patch).(map[string]interface{})
+	if !ok {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "", Message: "the document must be an object"})
+		return false
+	}
+	for name, value := range patched {
+		if _, ok := document[name]; !ok {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: name, Message: "unknown field"})
+			return false
+		}
+		if !contains(writable, name) && !reflect.DeepEqual(document[name], value) {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: name, Message: "read-only field"})
+			return false
+		}
+	}
+
+	b, _ = json.Marshal(patched)
+	if err := json.Unmarshal(b, model); err != nil {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "", Message: err.Error()})
+		return false
+	}
+	return true
+}
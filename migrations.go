@@ -0,0 +1,699 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// Migration is a numbered schema change. Up applies it and Down reverts it.
+// Once a migration has been deployed it must never be edited: add a new one
+// instead
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// migrations is the ordered list of every schema change, from the oldest to
+// the newest
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create users, tasks and comments",
+		// The statements are idempotent so that databases created before
+		// migrations existed are adopted instead of failing
+		Up: `CREATE OR REPLACE FUNCTION update_updated_at_column()
+RETURNS TRIGGER AS $$
+BEGIN
+	NEW.updated_at = CURRENT_TIMESTAMP;
+	RETURN NEW;
+END;
+$$ language 'plpgsql';
+
+CREATE TABLE IF NOT EXISTS users (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"username" TEXT,
+	"token" TEXT
+);
+
+DROP TRIGGER IF EXISTS update_users_updated_at ON users;
+CREATE TRIGGER update_users_updated_at BEFORE UPDATE
+ON users FOR EACH ROW EXECUTE PROCEDURE
+update_updated_at_column();
+
+CREATE TABLE IF NOT EXISTS tasks (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"name" TEXT NOT NULL,
+	"user_id" SERIAL REFERENCES users(id),
+	"description" TEXT,
+	"progression" integer DEFAULT 0
+);
+
+DROP TRIGGER IF EXISTS update_tasks_updated_at ON tasks;
+CREATE TRIGGER update_tasks_updated_at BEFORE UPDATE
+ON tasks FOR EACH ROW EXECUTE PROCEDURE
+update_updated_at_column();
+
+CREATE TABLE IF NOT EXISTS comments (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"user_id" SERIAL REFERENCES users(id),
+	"task_id" SERIAL REFERENCES tasks(id),
+	"content" TEXT
+);
+
+DROP TRIGGER IF EXISTS update_comments_updated_at ON comments;
+CREATE TRIGGER update_comments_updated_at BEFORE UPDATE
+ON comments FOR EACH ROW EXECUTE PROCEDURE
+update_updated_at_column();`,
+		Down: `DROP TABLE comments;
+DROP TABLE tasks;
+DROP TABLE users;
+DROP FUNCTION update_updated_at_column();`,
+	},
+	{
+		Version: 2,
+		Name:    "index tasks for keyset pagination",
+		Up: `CREATE INDEX tasks_created_at_id_idx ON tasks (created_at, id);
+CREATE INDEX tasks_updated_at_id_idx ON tasks (updated_at, id);
+CREATE INDEX tasks_user_id_created_at_id_idx ON tasks (user_id, created_at, id);`,
+		Down: `DROP INDEX tasks_created_at_id_idx;
+DROP INDEX tasks_updated_at_id_idx;
+DROP INDEX tasks_user_id_created_at_id_idx;`,
+	},
+	{
+		Version: 3,
+		Name:    "soft delete tasks and comments",
+		Up: `ALTER TABLE tasks ADD COLUMN "deleted_at" TIMESTAMP WITH TIME ZONE;
+ALTER TABLE comments ADD COLUMN "deleted_at" TIMESTAMP WITH TIME ZONE;
+CREATE INDEX tasks_deleted_at_idx ON tasks (deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX comments_deleted_at_idx ON comments (deleted_at) WHERE deleted_at IS NOT NULL;`,
+		Down: `ALTER TABLE comments DROP COLUMN "deleted_at";
+ALTER TABLE tasks DROP COLUMN "deleted_at";`,
+	},
+	{
+		Version: 4,
+		Name:    "version tasks and comments",
+		Up: `ALTER TABLE tasks ADD COLUMN "version" integer NOT NULL DEFAULT 1;
+ALTER TABLE comments ADD COLUMN "version" integer NOT NULL DEFAULT 1;`,
+		Down: `ALTER TABLE comments DROP COLUMN "version";
+ALTER TABLE tasks DROP COLUMN "version";`,
+	},
+	{
+		Version: 5,
+		Name:    "task statuses and transitions",
+		Up: `ALTER TABLE tasks ADD COLUMN "status" TEXT NOT NULL DEFAULT 'todo';
+CREATE INDEX tasks_status_idx ON tasks (status);
+
+CREATE TABLE task_transitions (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"task_id" integer NOT NULL REFERENCES tasks(id),
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"from_status" TEXT,
+	"to_status" TEXT NOT NULL
+);
+CREATE INDEX task_transitions_task_id_idx ON task_transitions (task_id, created_at);`,
+		Down: `DROP TABLE task_transitions;
+ALTER TABLE tasks DROP COLUMN "status";`,
+	},
+	{
+		Version: 6,
+		Name:    "task due and start dates, and reminders",
+		Up: `ALTER TABLE tasks ADD COLUMN "due_at" TIMESTAMP WITH TIME ZONE;
+ALTER TABLE tasks ADD COLUMN "start_at" TIMESTAMP WITH TIME ZONE;
+CREATE INDEX tasks_due_at_idx ON tasks (due_at) WHERE deleted_at IS NULL;
+
+CREATE TABLE reminders (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"task_id" integer NOT NULL REFERENCES tasks(id),
+	"kind" TEXT NOT NULL,
+	"due_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	"sink" TEXT NOT NULL,
+	UNIQUE ("task_id", "kind", "due_at", "sink")
+);`,
+		Down: `DROP TABLE reminders;
+ALTER TABLE tasks DROP COLUMN "start_at";
+ALTER TABLE tasks DROP COLUMN "due_at";`,
+	},
+	{
+		Version: 7,
+		Name:    "labels",
+		Up: `CREATE TABLE labels (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"name" TEXT NOT NULL UNIQUE,
+	"color" TEXT NOT NULL,
+	"description" TEXT NOT NULL DEFAULT ''
+);
+
+CREATE TRIGGER update_labels_updated_at BEFORE UPDATE
+ON labels FOR EACH ROW EXECUTE PROCEDURE
+update_updated_at_column();
+
+CREATE TABLE task_labels (
+	"task_id" integer NOT NULL REFERENCES tasks(id),
+	"label_id" integer NOT NULL REFERENCES labels(id) ON DELETE CASCADE,
+	PRIMARY KEY ("task_id", "label_id")
+);
+CREATE INDEX task_labels_label_id_idx ON task_labels (label_id);`,
+		Down: `DROP TABLE task_labels;
+DROP TABLE labels;`,
+	},
+	{
+		Version: 8,
+		Name:    "subtasks",
+		Up: `ALTER TABLE tasks ADD COLUMN "parent_id" integer REFERENCES tasks(id);
+ALTER TABLE tasks ADD COLUMN "weight" integer NOT NULL DEFAULT 1 CHECK (weight > 0);
+CREATE INDEX tasks_parent_id_idx ON tasks (parent_id) WHERE parent_id IS NOT NULL;`,
+		Down: `ALTER TABLE tasks DROP COLUMN "weight";
+ALTER TABLE tasks DROP COLUMN "parent_id";`,
+	},
+	{
+		Version: 9,
+		Name:    "task dependencies",
+		Up: `CREATE TABLE task_dependencies (
+	"task_id" integer NOT NULL REFERENCES tasks(id),
+	"blocker_id" integer NOT NULL REFERENCES tasks(id),
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY ("task_id", "blocker_id"),
+	CHECK (task_id <> blocker_id)
+);
+CREATE INDEX task_dependencies_blocker_id_idx ON task_dependencies (blocker_id);`,
+		Down: `DROP TABLE task_dependencies;`,
+	},
+	{
+		Version: 10,
+		Name:    "projects",
+		Up: `CREATE TABLE projects (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"name" TEXT NOT NULL,
+	"description" TEXT NOT NULL DEFAULT '',
+	"owner_id" integer NOT NULL REFERENCES users(id)
+);
+
+CREATE TRIGGER update_projects_updated_at BEFORE UPDATE
+ON projects FOR EACH ROW EXECUTE PROCEDURE
+update_updated_at_column();
+
+CREATE TABLE project_members (
+	"project_id" integer NOT NULL REFERENCES projects(id),
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY ("project_id", "user_id")
+);
+CREATE INDEX project_members_user_id_idx ON project_members (user_id);
+
+ALTER TABLE tasks ADD COLUMN "project_id" integer REFERENCES projects(id);
+CREATE INDEX tasks_project_id_created_at_id_idx ON tasks (project_id, created_at, id);`,
+		Down: `ALTER TABLE tasks DROP COLUMN "project_id";
+DROP TABLE project_members;
+DROP TABLE projects;`,
+	},
+	{
+		Version: 11,
+		Name:    "roles",
+		Up: `CREATE TABLE workspace_roles (
+	"user_id" integer PRIMARY KEY REFERENCES users(id),
+	"role" TEXT NOT NULL CHECK ("role" IN ('viewer', 'commenter', 'editor', 'admin', 'owner')),
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Every existing user keeps the permissions they had: viewing and commenting
+-- every task, and creating their own. The first user owns the workspace
+INSERT INTO workspace_roles ("user_id", "role")
+	SELECT id, CASE WHEN id = (SELECT min(id) FROM users) THEN 'owner' ELSE 'commenter' END FROM users;
+
+ALTER TABLE project_members ADD COLUMN "role" TEXT NOT NULL DEFAULT 'editor'
+	CHECK ("role" IN ('viewer', 'commenter', 'editor', 'admin', 'owner'));
+UPDATE project_members SET role = 'owner' FROM projects
+	WHERE projects.id = project_members.project_id AND projects.owner_id = project_members.user_id;`,
+		Down: `ALTER TABLE project_members DROP COLUMN "role";
+DROP TABLE workspace_roles;`,
+	},
+	{
+		Version: 12,
+		Name:    "user accounts",
+		// Usernames were never checked, so missing ones are generated and
+		// duplicates are suffixed with their ID before being made unique
+		Up: `UPDATE users SET username = 'user' || id WHERE username IS NULL OR username = '';
+UPDATE users SET username = username || '-' || id
+	WHERE id NOT IN (SELECT min(id) FROM users GROUP BY lower(username));
+ALTER TABLE users ALTER COLUMN "username" SET NOT NULL;
+CREATE UNIQUE INDEX users_lower_username_key ON users (lower(username));
+
+ALTER TABLE users ADD COLUMN "name" TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN "deactivated_at" TIMESTAMP WITH TIME ZONE;`,
+		Down: `ALTER TABLE users DROP COLUMN "deactivated_at";
+ALTER TABLE users DROP COLUMN "name";
+DROP INDEX users_lower_username_key;
+ALTER TABLE users ALTER COLUMN "username" DROP NOT NULL;`,
+	},
+	{
+		Version: 13,
+		Name:    "api tokens",
+		// The plaintext tokens are replaced by their SHA-256 hashes. They can't
+		// be restored on the way down, so users need new tokens after it
+		Up: `CREATE TABLE api_tokens (
+	"id" SERIAL PRIMARY KEY,
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"name" TEXT NOT NULL,
+	"hash" TEXT NOT NULL UNIQUE,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"last_used_at" TIMESTAMP WITH TIME ZONE,
+	"expires_at" TIMESTAMP WITH TIME ZONE,
+	"revoked_at" TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX api_tokens_user_id_idx ON api_tokens (user_id);
+
+INSERT INTO api_tokens ("user_id", "name", "hash")
+	SELECT id, 'default', encode(sha256(convert_to(token, 'UTF8')), 'hex') FROM users WHERE token IS NOT NULL AND token <> '';
+ALTER TABLE users DROP COLUMN "token";`,
+		Down: `ALTER TABLE users ADD COLUMN "token" TEXT;
+DROP TABLE api_tokens;`,
+	},
+	{
+		Version: 14,
+		Name:    "token scopes",
+		// Existing tokens keep a NULL scopes, which grants every scope
+		Up:   `ALTER TABLE api_tokens ADD COLUMN "scopes" TEXT[];`,
+		Down: `ALTER TABLE api_tokens DROP COLUMN "scopes";`,
+	},
+	{
+		Version: 15,
+		Name:    "oauth",
+		// OAuth access tokens are API tokens with a client, so that they are
+		// checked like the others
+		Up: `CREATE TABLE oauth_clients (
+	"id" SERIAL PRIMARY KEY,
+	"client_id" TEXT NOT NULL UNIQUE,
+	"secret_hash" TEXT,
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"name" TEXT NOT NULL,
+	"redirect_uris" TEXT[] NOT NULL DEFAULT '{}',
+	"scopes" TEXT[],
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"revoked_at" TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+CREATE TABLE oauth_codes (
+	"hash" TEXT PRIMARY KEY,
+	"client_id" integer NOT NULL REFERENCES oauth_clients(id),
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"redirect_uri" TEXT NOT NULL,
+	"scopes" TEXT[],
+	"code_challenge" TEXT,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"expires_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	"used_at" TIMESTAMP WITH TIME ZONE
+);
+
+CREATE TABLE oauth_refresh_tokens (
+	"id" SERIAL PRIMARY KEY,
+	"client_id" integer NOT NULL REFERENCES oauth_clients(id),
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"hash" TEXT NOT NULL UNIQUE,
+	"scopes" TEXT[],
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"expires_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	"revoked_at" TIMESTAMP WITH TIME ZONE
+);
+
+ALTER TABLE api_tokens ADD COLUMN "client_id" integer REFERENCES oauth_clients(id);`,
+		Down: `DELETE FROM api_tokens WHERE client_id IS NOT NULL;
+ALTER TABLE api_tokens DROP COLUMN "client_id";
+DROP TABLE oauth_refresh_tokens;
+DROP TABLE oauth_codes;
+DROP TABLE oauth_clients;`,
+	},
+	{
+		Version: 16,
+		Name:    "passwords and sessions",
+		// Users without a password can only authenticate with a token
+		Up: `ALTER TABLE users ADD COLUMN "password_hash" TEXT;
+
+CREATE TABLE sessions (
+	"id" SERIAL PRIMARY KEY,
+	"hash" TEXT NOT NULL UNIQUE,
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"csrf_token" TEXT NOT NULL,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"expires_at" TIMESTAMP WITH TIME ZONE NOT NULL
+);
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);`,
+		Down: `DROP TABLE sessions;
+ALTER TABLE users DROP COLUMN "password_hash";`,
+	},
+	{
+		Version: 17,
+		Name:    "auth failures",
+		// The keys are the IPs and the credentials that failed to
+		// authenticate, so that every instance throttles them alike
+		Up: `CREATE TABLE auth_failures (
+	"key" TEXT PRIMARY KEY,
+	"failures" integer NOT NULL,
+	"failed_at" TIMESTAMP WITH TIME ZONE NOT NULL,
+	"locked_until" TIMESTAMP WITH TIME ZONE
+);`,
+		Down: `DROP TABLE auth_failures;`,
+	},
+	{
+		Version: 18,
+		Name:    "audit log",
+		// Entries are written in the transaction of the change they record.
+		// The actor is NULL when users sign up by themselves
+		Up: `CREATE TABLE audit_log (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"actor_id" integer REFERENCES users(id),
+	"request_id" TEXT,
+	"action" TEXT NOT NULL,
+	"resource" TEXT NOT NULL,
+	"before" JSONB,
+	"after" JSONB,
+	"patch" JSONB
+);
+CREATE INDEX audit_log_actor_id_idx ON audit_log (actor_id);
+CREATE INDEX audit_log_resource_idx ON audit_log (resource text_pattern_ops);
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);`,
+		Down: `DROP TABLE audit_log;`,
+	},
+	{
+		Version: 19,
+		Name:    "task events",
+		// Events are kept after their task is purged, until they are, so
+		// task_id isn't a foreign key
+		Up: `CREATE TABLE task_events (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"type" TEXT NOT NULL,
+	"resource" TEXT NOT NULL,
+	"task_id" integer NOT NULL,
+	"user_id" integer NOT NULL,
+	"project_id" integer,
+	"actor_id" integer,
+	"data" JSONB
+);
+CREATE INDEX task_events_created_at_idx ON task_events (created_at);`,
+		Down: `DROP TABLE task_events;`,
+	},
+	{
+		Version: 20,
+		Name:    "task viewers",
+		// A row is a WebSocket connection viewing a task. It is refreshed
+		// while the connection lasts, so that the rows of the connections of
+		// a stopped instance expire
+		Up: `CREATE TABLE task_viewers (
+	"connection_id" TEXT NOT NULL,
+	"task_id" integer NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"seen_at" TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY ("connection_id", "task_id")
+);
+CREATE INDEX task_viewers_task_id_idx ON task_viewers (task_id);`,
+		Down: `DROP TABLE task_viewers;`,
+	},
+	{
+		Version: 21,
+		Name:    "webhooks",
+		// The secret is stored as is, because it signs the payloads.
+		// Deliveries are the outbox of the webhooks: they are inserted in
+		// the transaction of the change, and sent by a worker
+		Up: `CREATE TABLE webhooks (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"user_id" integer NOT NULL REFERENCES users(id),
+	"project_id" integer REFERENCES projects(id),
+	"url" TEXT NOT NULL,
+	"events" TEXT[] NOT NULL,
+	"secret" TEXT NOT NULL
+);
+CREATE INDEX webhooks_project_id_idx ON webhooks (project_id);
+CREATE TABLE webhook_deliveries (
+	"id" SERIAL PRIMARY KEY,
+	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"webhook_id" integer NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+	"event_id" integer NOT NULL,
+	"event_type" TEXT NOT NULL,
+	"payload" JSONB NOT NULL,
+	"attempts" integer NOT NULL DEFAULT 0,
+	"next_attempt_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"delivered_at" TIMESTAMP WITH TIME ZONE,
+	"failed_at" TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id);
+CREATE INDEX webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE delivered_at IS NULL AND failed_at IS NULL;
+CREATE TABLE webhook_attempts (
+	"id" SERIAL PRIMARY KEY,
+	"delivery_id" integer NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+	"attempted_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	"status_code" integer,
+	"error" TEXT,
+	"duration_ms" integer NOT NULL
+);
+CREATE INDEX webhook_attempts_delivery_id_idx ON webhook_attempts (delivery_id);`,
+		Down: `DROP TABLE webhook_attempts;
+DROP TABLE webhook_deliveries;
+DROP TABLE webhooks;`,
+	},
+	{
+		Version: 22,
+		Name:    "task revisions baseline",
+		// The tasks created before the audit log get a create revision,
+		// tagged with the request ID of the migration so that Down can
+		// delete them
+		Up: `CREATE INDEX audit_log_resource_created_at_idx ON audit_log (resource, created_at);
+` + baselineTaskRevisions,
+		Down: `DELETE FROM audit_log WHERE request_id = '` + baselineRequestID + `';
+DROP INDEX audit_log_resource_created_at_idx;`,
+	},
+	{
+		Version: 23,
+		Name:    "reminder status",
+		// The reminders recorded so far were sent
+		Up:   `ALTER TABLE reminders ADD COLUMN "status" TEXT NOT NULL DEFAULT 'sent';`,
+		Down: `ALTER TABLE reminders DROP COLUMN "status";`,
+	},
+}
+
+// baselineRequestID is the request ID of the revisions that migration 22
+// backfilled
+const baselineRequestID = "migration-22"
+
+// baselineTaskSnapshot builds the JSON of a task as migration 22 knew it. The
+// blocked field is left out, because it depends on the workflow
+const baselineTaskSnapshot = `jsonb_build_object(
+		'id', tasks.id,
+		'created_at', tasks.created_at,
+		'updated_at', tasks.updated_at,
+		'user', jsonb_build_object('id', users.id, 'username', users.username),
+		'name', tasks.name,
+		'description', coalesce(tasks.description, ''),
+		'progression', tasks.progression,
+		'status', tasks.status,
+		'due_at', tasks.due_at,
+		'start_at', tasks.start_at,
+		'labels', ARRAY(SELECT labels.name FROM task_labels JOIN labels ON task_labels.label_id = labels.id WHERE task_labels.task_id = tasks.id ORDER BY labels.name),
+		'parent_id', tasks.parent_id,
+		'project_id', tasks.project_id,
+		'weight', tasks.weight,
+		'subtasks', (SELECT count(*) FROM tasks AS subtasks WHERE subtasks.parent_id = tasks.id AND subtasks.deleted_at IS NULL)
+	) - CASE WHEN coalesce(tasks.description, '') = '' THEN 'description' ELSE '' END`
+
+// baselineTaskRevisions records a create revision of the tasks that have none,
+// because they were created before the audit log, dated of their creation.
+// Their state back then is unknown, so the revision holds their state before
+// their oldest revision, or their current state if they have none. The tasks
+// in the trash without revisions also get a delete revision, recorded first so
+// that it is the oldest one
+const baselineTaskRevisions = `INSERT INTO audit_log ("created_at", "request_id", "action", "resource", "before")
+SELECT tasks.deleted_at, '` + baselineRequestID + `', 'delete', '/tasks/' || tasks.id, ` + baselineTaskSnapshot + `
+FROM tasks JOIN users ON tasks.user_id = users.id
+WHERE tasks.deleted_at IS NOT NULL AND NOT EXISTS (SELECT 1 FROM audit_log WHERE audit_log.resource = '/tasks/' || tasks.id);
+
+INSERT INTO audit_log ("created_at", "request_id", "action", "resource", "after")
+SELECT tasks.created_at, '` + baselineRequestID + `', 'create', '/tasks/' || tasks.id, coalesce(
+	(SELECT audit_log.before FROM audit_log WHERE audit_log.resource = '/tasks/' || tasks.id ORDER BY audit_log.created_at, audit_log.id LIMIT 1),
+	` + baselineTaskSnapshot + `)
+FROM tasks JOIN users ON tasks.user_id = users.id
+WHERE NOT EXISTS (SELECT 1 FROM audit_log WHERE audit_log.resource = '/tasks/' || tasks.id AND audit_log.action = 'create');`
+
+// migrationsLockID is the key of the advisory lock that serializes migrations
+// between instances booting at the same time
+const migrationsLockID = 4242
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	"version" integer PRIMARY KEY,
+	"name" TEXT NOT NULL,
+	"applied_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);`
+
+// migrateUp applies every pending migration. It is safe to call at every boot
+func migrateUp() error {
+	for _, m := range migrations {
+		if err := migrate(m, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateDown reverts every applied migration whose version is greater than
+// target, from the newest to the oldest
+func migrateDown(target int) error {
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if migrations[i].Version <= target {
+			break
+		}
+		if err := migrate(migrations[i], false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrate applies (or reverts) a single migration and records it in
+// schema_migrations, in one transaction. The transaction holds an advisory
+// lock so that concurrent instances can't run the same migration twice
+func migrate(m Migration, up bool) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return fmt.Errorf("couldn't begin: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrationsLockID); err != nil {
+		return fmt.Errorf("couldn't lock schema_migrations: %v", err)
+	}
+	if _, err := tx.Exec(createSchemaMigrations); err != nil {
+		return fmt.Errorf("couldn't create schema_migrations: %v", err)
+	}
+
+	var applied bool
+	if err := tx.Get(&applied, `SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = $1)`, m.Version); err != nil {
+		return fmt.Errorf("couldn't select from schema_migrations: %v", err)
+	}
+	if applied == up {
+		return nil
+	}
+
+	if up {
+		if _, err := tx.Exec(m.Up); err != nil {
+			return fmt.Errorf("couldn't apply migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations ("version", "name") VALUES ($1, $2)`, m.Version, m.Name); err != nil {
+			return fmt.Errorf("couldn't insert to schema_migrations: %v", err)
+		}
+	} else {
+		if _, err := tx.Exec(m.Down); err != nil {
+			return fmt.Errorf("couldn't revert migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		if _, err := tx.Exec(`DELETE FROM schema_migrations WHERE version = $1`, m.Version); err != nil {
+			return fmt.Errorf("couldn't delete from schema_migrations: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("couldn't commit: %v", err)
+	}
+	if up {
+		log.Printf("applied migration %d (%s)", m.Version, m.Name)
+	} else {
+		log.Printf("reverted migration %d (%s)", m.Version, m.Name)
+	}
+	return nil
+}
+
+// appliedMigrations returns the application date of every applied migration,
+// by version
+func appliedMigrations() (map[int]time.Time, error) {
+	if _, err := db.Exec(createSchemaMigrations); err != nil {
+		return nil, fmt.Errorf("couldn't create schema_migrations: %v", err)
+	}
+	var rows []struct {
+		Version   int
+		AppliedAt time.Time `db:"applied_at"`
+	}
+	if err := db.Select(&rows, `SELECT version, applied_at FROM schema_migrations`); err != nil {
+		return nil, fmt.Errorf("couldn't select from schema_migrations: %v", err)
+	}
+	applied := make(map[int]time.Time)
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+// migrationStatus writes the state of every migration to w
+func migrationStatus(w io.Writer) error {
+	applied, err := appliedMigrations()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, m := range migrations {
+		appliedAt, ok := applied[m.Version]
+		status := "pending"
+		if ok {
+			status = appliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.Version, m.Name, status)
+	}
+	return tw.Flush()
+}
+
+// runMigrate implements the "migrate up|down [version]|status" mode of the
+// binary. Without a version, down reverts the latest applied migration only
+func runMigrate(w io.Writer, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down [version]|status")
+	}
+	switch args[0] {
+	case "up":
+		return migrateUp()
+	case "down":
+		if len(args) > 1 {
+			target, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid version %q: %v", args[1], err)
+			}
+			return migrateDown(target)
+		}
+		applied, err := appliedMigrations()
+		if err != nil {
+			return err
+		}
+		target := 0
+		latest := false
+		for i := len(migrations) - 1; i >= 0; i-- {
+			if _, ok := applied[migrations[i].Version]; !ok {
+				continue
+			}
+			if latest {
+				target = migrations[i].Version
+				break
+			}
+			latest = true
+		}
+		return migrateDown(target)
+	case "status":
+		return migrationStatus(w)
+	}
+	return fmt.Errorf("unknown migrate command %q", args[0])
+}
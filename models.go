@@ -12,8 +12,14 @@ type Model struct {
 // User is a model that represents a user in the database
 type User struct {
 	Model
-	Username string
-	Token    string
+	Username      string
+	Name          string
+	DeactivatedAt *time.Time `db:"deactivated_at"`
+
+	// scopes are the scopes of the token the user authenticated with, and
+	// bearer tells whether it is an OAuth access token
+	scopes tokenScopes
+	bearer bool
 }
 
 // Task is a model that represents a task in the database
@@ -23,6 +29,12 @@ type Task struct {
 	Name        string `binding:"required"`
 	Description string
 	Progression int
+	Status      string
+	DueAt       *time.Time `json:"due_at"`
+	StartAt     *time.Time `json:"start_at"`
+	ParentID    *int       `json:"parent_id"`
+	Weight      int        `json:"weight"`
+	ProjectID   *int       `json:"project_id"`
 }
 
 // Comment is a model that represents a comment in the database
@@ -32,3 +44,19 @@ type Comment struct {
 	UserID  int    `json:",omitempty"`
 	Content string `binding:"required"`
 }
+
+// Label is a model that represents a label in the database
+type Label struct {
+	Model
+	Name        string `binding:"required"`
+	Color       string
+	Description string
+}
+
+// Project is a model that represents a project in the database
+type Project struct {
+	Model
+	Name        string `binding:"required"`
+	Description string
+	OwnerID     int `json:",omitempty"`
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+const (
+	// oauthCodeTTL is how long an authorization code can be exchanged
+	oauthCodeTTL = 10 * time.Minute
+	// oauthAccessTokenTTL is how long an OAuth access token works
+	oauthAccessTokenTTL = time.Hour
+	// oauthRefreshTokenTTL is how long an OAuth refresh token works, unless
+	// it's used before
+	oauthRefreshTokenTTL = 30 * 24 * time.Hour
+)
+
+// codeVerifierRegexp matches the PKCE code verifiers of RFC 7636
+var codeVerifierRegexp = regexp.MustCompile(`^[A-Za-z0-9._~-]{43,128}$`)
+
+// oauthClient is an OAuth client, with what only the server knows about it
+type oauthClient struct {
+	ClientResource
+	UserID     int     `db:"user_id"`
+	SecretHash *string `db:"secret_hash"`
+}
+
+// OAuthError is an error of the OAuth token endpoint, as defined by RFC 6749
+type OAuthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+// checkRedirectURI returns a *FieldError unless uri can be a redirect URI: an
+// absolute https URL without fragment, or an http URL on the loopback
+// interface for native apps
+func checkRedirectURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+		return &FieldError{Field: "redirect_uris", Message: fmt.Sprintf("%q must be an absolute URL without fragment", uri)}
+	}
+	if u.Scheme == "https" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host
+	}
+	if u.Scheme == "http" && (host == "localhost" || net.ParseIP(host).IsLoopback()) {
+		return nil
+	}
+	return &FieldError{Field: "redirect_uris", Message: fmt.Sprintf("%q must be https, or http on localhost", uri)}
+}
+
+// parseScope parses the space separated scope parameter of OAuth. It returns
+// nil if it's empty
+func parseScope(scope string) tokenScopes {
+	fields := strings.Fields(scope)
+	if len(fields) == 0 {
+		return nil
+	}
+	return tokenScopes(fields)
+}
+
+// formatScope formats scopes as the scope parameter of OAuth
+func formatScope(s tokenScopes) string {
+	if s == nil {
+		return strings.Join(scopes, " ")
+	}
+	return strings.Join(s, " ")
+}
+
+func getOAuthClientsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	clients := []ClientResource{}
+	if err := selectOAuthClientsWhereUserID.Select(&clients, user.ID); err != nil {
+		log.Printf("couldn't select from oauth_clients: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, clients)
+}
+
+// postOAuthClientsHandler registers an OAuth client. Confidential clients get a
+// secret, which can't be fetched again. Public clients, e.g. single page or
+// native apps, can't keep a secret and must use PKCE. The scopes of a client
+// are the most it can be granted; they can't be more than the scopes of the
+// token used to register it, and default to them. Clients can't be granted
+// the credential scopes
+func postOAuthClientsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, clientManage); !ok {
+		return
+	}
+
+	var body struct {
+		Name         string   `json:"name" binding:"required"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Public       bool     `json:"public"`
+		Scopes       []string `json:"scopes"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	for _, uri := range body.RedirectURIs {
+		if err := checkRedirectURI(uri); err != nil {
+			c.JSON(http.StatusBadRequest, err)
+			return
+		}
+	}
+	if body.RedirectURIs == nil {
+		if body.Public {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: "redirect_uris", Message: "public clients need a redirect URI"})
+			return
+		}
+		body.RedirectURIs = []string{}
+	}
+	requested := user.scopes.grantable()
+	if body.Scopes != nil {
+		if err := checkScopes(body.Scopes); err != nil {
+			c.JSON(http.StatusBadRequest, err)
+			return
+		}
+		for _, scope := range body.Scopes {
+			if credentialScopes[scope] {
+				c.JSON(http.StatusBadRequest, &FieldError{Field: "scopes", Message: fmt.Sprintf("%q can't be granted to OAuth clients", scope)})
+				return
+			}
+		}
+		requested = tokenScopes(body.Scopes)
+		if scope := user.scopes.missing(requested); scope != "" && !authorizeScope(c, user, scope) {
+			return
+		}
+	}
+	if len(requested) == 0 {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "scopes", Message: "the token has no scope that OAuth clients can be granted"})
+		return
+	}
+
+	clientID, err := newToken()
+	if err != nil {
+		log.Printf("couldn't generate a client ID: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var registered struct {
+		ClientResource
+		ClientSecret string `json:"client_secret,omitempty"`
+	}
+	var secretHash *string
+	if !body.Public {
+		if registered.ClientSecret, err = newToken(); err != nil {
+			log.Printf("couldn't generate a client secret: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		hash := hashToken(registered.ClientSecret)
+		secretHash = &hash
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = tx.Stmtx(insertOAuthClient).Get(&registered.ClientResource, clientID, secretHash, user.ID, body.Name, pq.StringArray(body.RedirectURIs), pq.StringArray(requested))
+	if err != nil {
+		log.Printf("couldn't insert to oauth_clients: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "create", "/oauth/clients/"+strconv.Itoa(registered.ID), nil, registered.ClientResource, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", "/oauth/clients/"+strconv.Itoa(registered.ID))
+	c.JSON(http.StatusCreated, registered)
+}
+
+// deleteOAuthClientsIDHandler revokes an OAuth client registered by the
+// authenticated user. Its tokens stop working immediately
+func deleteOAuthClientsIDHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var revoked ClientResource
+	err = tx.Stmtx(revokeOAuthClient).Get(&revoked, id, user.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't update oauth_clients: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "delete", "/oauth/clients/"+strconv.Itoa(id), nil, revoked, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// authorizationRequest is an OAuth authorization request, from the query of
+// the consent page or from its form
+type authorizationRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	// client and scopes are the client and the scopes of a checked request,
+	// and redirectURI is where to redirect the user
+	client      oauthClient
+	scopes      tokenScopes
+	redirectURI string
+}
+
+// readAuthorizationRequest reads an authorization request with get, which is
+// either c.Query or c.PostForm
+func readAuthorizationRequest(get func(string) string) *authorizationRequest {
+	return &authorizationRequest{
+		ResponseType:        get("response_type"),
+		ClientID:            get("client_id"),
+		RedirectURI:         get("redirect_uri"),
+		Scope:               get("scope"),
+		State:               get("state"),
+		CodeChallenge:       get("code_challenge"),
+		CodeChallengeMethod: get("code_challenge_method"),
+	}
+}
+
+// checkAuthorizationRequest selects the client of an authorization request and
+// checks the request. The errors about the client or the redirect URI are
+// answered to the user, because redirecting them would be unsafe, and the
+// others are redirected to the client. It answers and returns false if the
+// request is invalid
+func checkAuthorizationRequest(c *gin.Context, req *authorizationRequest) bool {
+	err := selectOAuthClientWhereClientID.Get(&req.client, req.ClientID)
+	if err == sql.ErrNoRows {
+		c.String(http.StatusBadRequest, "Unknown client.")
+		return false
+	}
+	if err != nil {
+		log.Printf("couldn't select from oauth_clients: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	// The redirect URI can only be omitted if the client has a single one
+	if req.RedirectURI == "" && len(req.client.RedirectURIs) == 1 {
+		req.redirectURI = req.client.RedirectURIs[0]
+	}
+	for _, uri := range req.client.RedirectURIs {
+		if uri == req.RedirectURI {
+			req.redirectURI = uri
+		}
+	}
+	if req.redirectURI == "" {
+		c.String(http.StatusBadRequest, "The redirect URI isn't registered for this client.")
+		return false
+	}
+
+	if req.ResponseType != "code" {
+		redirectAuthorizationError(c, req, "unsupported_response_type", "only the code response type is supported")
+		return false
+	}
+	if req.CodeChallenge == "" && req.client.Public {
+		redirectAuthorizationError(c, req, "invalid_request", "public clients must use PKCE")
+		return false
+	}
+	if req.CodeChallenge != "" && req.CodeChallengeMethod != "S256" {
+		redirectAuthorizationError(c, req, "invalid_request", "the code challenge method must be S256")
+		return false
+	}
+	// Clients registered before their scopes were required have none, which
+	// stands for every scope they can be granted
+	granted := tokenScopes(req.client.Scopes).grantable()
+	req.scopes = parseScope(req.Scope)
+	if req.scopes == nil {
+		req.scopes = granted
+	} else if err := checkScopes(req.scopes); err != nil {
+		redirectAuthorizationError(c, req, "invalid_scope", err.(*FieldError).Message)
+		return false
+	} else if scope := granted.missing(req.scopes); scope != "" {
+		redirectAuthorizationError(c, req, "invalid_scope", "the client can't be granted the "+scope+" scope")
+		return false
+	}
+	return true
+}
+
+// redirectAuthorizationError redirects the user to the client with an error
+func redirectAuthorizationError(c *gin.Context, req *authorizationRequest, code, description string) {
+	redirectAuthorization(c, req, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// redirectAuthorization redirects the user to the client with params and the
+// state of the request
+func redirectAuthorization(c *gin.Context, req *authorizationRequest, params url.Values) {
+	u, _ := url.Parse(req.redirectURI)
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+	c.Redirect(http.StatusFound, u.String())
+}
+
+// consentTemplate is the consent page, where users grant scopes to a client
+var consentTemplate = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorize {{.Client.Name}}</title>
+</head>
+<body>
+<h1>Authorize {{.Client.Name}}</h1>
+{{if .Error}}<p><strong>{{.Error}}</strong></p>
+{{end}}<p>{{.Client.Name}} wants to use the task manager on your behalf, with the following scopes:</p>
+<ul>
+{{range .Scopes}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .CSRFToken}}<form method="post" action="/oauth/authorize">
+<input type="hidden" name="response_type" value="{{.Request.ResponseType}}">
+<input type="hidden" name="client_id" value="{{.Request.ClientID}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectURI}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<input type="hidden" name="csrf_token" value="{{.CSRFToken}}">
+<button type="submit" name="consent" value="approve">Approve</button>
+<button type="submit" name="consent" value="deny">Deny</button>
+</form>
+{{else}}<p>Log in to the task manager, then reload this page to approve or deny.</p>
+{{end}}</body>
+</html>
+`))
+
+// renderConsent answers the consent page of an authorization request. Users
+// approve with their session, so they must log in first
+func renderConsent(c *gin.Context, statusCode int, req *authorizationRequest, message string) {
+	s, err := selectSession(c)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("couldn't select from sessions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	// The consent page can't be framed, so that users can't be tricked into
+	// approving
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Cache-Control", "no-store")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Writer.WriteHeader(statusCode)
+	err = consentTemplate.Execute(c.Writer, struct {
+		Client    ClientResource
+		Scopes    []string
+		Request   *authorizationRequest
+		Error     string
+		CSRFToken string
+	}{req.client.ClientResource, strings.Fields(formatScope(req.scopes)), req, message, s.CSRFToken})
+	if err != nil {
+		log.Printf("couldn't render the consent page: %v", err)
+	}
+}
+
+// getOAuthAuthorizeHandler answers the consent page of an authorization
+// request
+func getOAuthAuthorizeHandler(c *gin.Context) {
+	req := readAuthorizationRequest(c.Query)
+	if !checkAuthorizationRequest(c, req) {
+		return
+	}
+
+	renderConsent(c, http.StatusOK, req, "")
+}
+
+// postOAuthAuthorizeHandler handles the consent form. If the user approves, it
+// redirects them to the client with an authorization code. The form
+// authenticates users with their session and its CSRF token, which the browser
+// doesn't send by itself, so that the form can't be forged by another site.
+// Users never type a credential in it, so that it can't be phished
+func postOAuthAuthorizeHandler(c *gin.Context) {
+	req := readAuthorizationRequest(c.PostForm)
+	if !checkAuthorizationRequest(c, req) {
+		return
+	}
+	if c.PostForm("consent") != "approve" {
+		redirectAuthorizationError(c, req, "access_denied", "the user denied the request")
+		return
+	}
+
+	s, err := selectSession(c)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("couldn't select from sessions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err == sql.ErrNoRows || !s.checkCSRF(c.PostForm("csrf_token")) {
+		renderConsent(c, http.StatusUnauthorized, req, "Your session expired.")
+		return
+	}
+
+	code, err := newToken()
+	if err != nil {
+		log.Printf("couldn't generate an authorization code: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var challenge *string
+	if req.CodeChallenge != "" {
+		challenge = &req.CodeChallenge
+	}
+	_, err = insertOAuthCode.Exec(hashToken(code), req.client.ID, s.User.ID, req.RedirectURI, pq.StringArray(req.scopes), challenge, time.Now().Add(oauthCodeTTL))
+	if err != nil {
+		log.Printf("couldn't insert to oauth_codes: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	redirectAuthorization(c, req, url.Values{"code": {code}})
+}
+
+// oauthTokenResponse is the response of the OAuth token endpoint
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// oauthError answers an error of the OAuth token endpoint
+func oauthError(c *gin.Context, statusCode int, code, description string) {
+	if statusCode == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", "Basic")
+	}
+	c.JSON(statusCode, &OAuthError{Code: code, Description: description})
+	c.Abort()
+}
+
+// authenticateClient authenticates the client of a token request, with HTTP
+// Basic authentication or with the client_id and client_secret parameters.
+// Public clients only send their client_id. It answers and returns false if
+// the client isn't authenticated
+func authenticateClient(c *gin.Context) (oauthClient, bool) {
+	clientID, secret, ok := c.Request.BasicAuth()
+	if !ok {
+		clientID, secret = c.PostForm("client_id"), c.PostForm("client_secret")
+	}
+
+	attempt := newAuthAttempt(c, "client", clientID, false)
+	locked, failed := attempt.locked(c)
+	if locked {
+		return oauthClient{}, false
+	}
+	var client oauthClient
+	err := selectOAuthClientWhereClientID.Get(&client, clientID)
+	if err == sql.ErrNoRows {
+		attempt.fail("unknown client")
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "unknown client")
+		return oauthClient{}, false
+	}
+	if err != nil {
+		log.Printf("couldn't select from oauth_clients: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return oauthClient{}, false
+	}
+	if client.SecretHash == nil && secret != "" ||
+		client.SecretHash != nil && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(*client.SecretHash)) != 1 {
+		attempt.fail("wrong client secret")
+		oauthError(c, http.StatusUnauthorized, "invalid_client", "wrong client secret")
+		return oauthClient{}, false
+	}
+	if failed {
+		attempt.succeed()
+	}
+	return client, true
+}
+
+// postOAuthTokenHandler issues OAuth access tokens, for the authorization_code,
+// refresh_token and client_credentials grants
+func postOAuthTokenHandler(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+	client, ok := authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	switch grantType := c.PostForm("grant_type"); grantType {
+	case "authorization_code":
+		exchangeAuthorizationCode(c, tx, client)
+	case "refresh_token":
+		exchangeRefreshToken(c, tx, client)
+	case "client_credentials":
+		exchangeClientCredentials(c, tx, client)
+	case "":
+		oauthError(c, http.StatusBadRequest, "invalid_request", "grant_type is missing")
+	default:
+		oauthError(c, http.StatusBadRequest, "unsupported_grant_type", grantType+" isn't supported")
+	}
+}
+
+// oauthGrant is what a client was granted: acting as a user, with scopes
+type oauthGrant struct {
+	ClientID int            `db:"client_id"`
+	UserID   int            `db:"user_id"`
+	Scopes   pq.StringArray `db:"scopes"`
+}
+
+// exchangeAuthorizationCode issues tokens for an authorization code. The code
+// works once, for the client it was issued to, and with the verifier of its
+// PKCE challenge if it has one
+func exchangeAuthorizationCode(c *gin.Context, tx *sqlx.Tx, client oauthClient) {
+	var code struct {
+		oauthGrant
+		RedirectURI   string  `db:"redirect_uri"`
+		CodeChallenge *string `db:"code_challenge"`
+	}
+	err := tx.Stmtx(useOAuthCode).Get(&code, hashToken(c.PostForm("code")))
+	if err == sql.ErrNoRows {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the code is invalid, expired or already used")
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't update oauth_codes: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectURI != c.PostForm("redirect_uri") {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the code was issued to another client or redirect URI")
+		return
+	}
+	if code.CodeChallenge != nil {
+		verifier := c.PostForm("code_verifier")
+		sum := sha256.Sum256([]byte(verifier))
+		if !codeVerifierRegexp.MatchString(verifier) || base64.RawURLEncoding.EncodeToString(sum[:]) != *code.CodeChallenge {
+			oauthError(c, http.StatusBadRequest, "invalid_grant", "the code verifier doesn't match the code challenge")
+			return
+		}
+	}
+
+	issueOAuthTokens(c, tx, client, code.oauthGrant, tokenScopes(code.Scopes).grantable(), true)
+}
+
+// exchangeRefreshToken issues tokens for a refresh token, which is replaced by
+// a new one. The access token can have fewer scopes than the refresh token
+func exchangeRefreshToken(c *gin.Context, tx *sqlx.Tx, client oauthClient) {
+	var grant oauthGrant
+	err := tx.Stmtx(useOAuthRefreshToken).Get(&grant, hashToken(c.PostForm("refresh_token")))
+	if err == sql.ErrNoRows {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the refresh token is invalid, expired or already used")
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't update oauth_refresh_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if grant.ClientID != client.ID {
+		oauthError(c, http.StatusBadRequest, "invalid_grant", "the refresh token was issued to another client")
+		return
+	}
+	scopes, ok := requestedScopes(c, tokenScopes(grant.Scopes))
+	if !ok {
+		return
+	}
+
+	issueOAuthTokens(c, tx, client, grant, scopes, true)
+}
+
+// exchangeClientCredentials issues an access token to a confidential client,
+// which acts as the user who registered it. There is no refresh token: the
+// client asks for another access token instead
+func exchangeClientCredentials(c *gin.Context, tx *sqlx.Tx, client oauthClient) {
+	if client.Public {
+		oauthError(c, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client_credentials grant")
+		return
+	}
+	scopes, ok := requestedScopes(c, tokenScopes(client.Scopes))
+	if !ok {
+		return
+	}
+
+	issueOAuthTokens(c, tx, client, oauthGrant{ClientID: client.ID, UserID: client.UserID}, scopes, false)
+}
+
+// requestedScopes returns the scopes of the scope parameter, which can't be
+// more than granted. It returns granted if the parameter is missing, or
+// answers and returns false. Grants made before their scopes were required
+// have none, which stands for every scope that clients can be granted
+func requestedScopes(c *gin.Context, granted tokenScopes) (tokenScopes, bool) {
+	granted = granted.grantable()
+	requested := parseScope(c.PostForm("scope"))
+	if requested == nil {
+		return granted, true
+	}
+	if err := checkScopes(requested); err != nil {
+		oauthError(c, http.StatusBadRequest, "invalid_scope", err.(*FieldError).Message)
+		return nil, false
+	}
+	if scope := granted.missing(requested); scope != "" {
+		oauthError(c, http.StatusBadRequest, "invalid_scope", "the "+scope+" scope wasn't granted")
+		return nil, false
+	}
+	return requested, true
+}
+
+// issueOAuthTokens issues an access token with scopes, and a refresh token
+// with the scopes of the grant if refresh is true
+func issueOAuthTokens(c *gin.Context, tx *sqlx.Tx, client oauthClient, grant oauthGrant, scopes tokenScopes, refresh bool) {
+	response := &oauthTokenResponse{TokenType: "Bearer", ExpiresIn: int(oauthAccessTokenTTL.Seconds()), Scope: formatScope(scopes)}
+	var err error
+	if response.AccessToken, err = newToken(); err != nil {
+		log.Printf("couldn't generate an access token: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Stmtx(insertAccessToken).Exec(grant.UserID, client.Name, hashToken(response.AccessToken), time.Now().Add(oauthAccessTokenTTL), pq.StringArray(scopes), client.ID)
+	if err != nil {
+		log.Printf("couldn't insert to api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if refresh {
+		if response.RefreshToken, err = newToken(); err != nil {
+			log.Printf("couldn't generate a refresh token: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Stmtx(insertOAuthRefreshToken).Exec(client.ID, grant.UserID, hashToken(response.RefreshToken), grant.Scopes, time.Now().Add(oauthRefreshTokenTTL))
+		if err != nil {
+			log.Printf("couldn't insert to oauth_refresh_tokens: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, response)
+}
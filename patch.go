@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// acceptPatch lists the patch document formats accepted by PATCH /tasks/:id
+const acceptPatch = "application/json-patch+json, application/merge-patch+json"
+
+// FieldError is returned when a patched task has an invalid field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("%q: %s", e.Field, e.Message)
+}
+
+// taskPatchContext is the task being patched, the user patching it and their
+// roles on the task
+type taskPatchContext struct {
+	task  *TaskResource
+	user  User
+	roles []string
+	// changed are the other tasks that the changes changed, as they were
+	// before
+	changed []TaskResource
+}
+
+// taskField is a field of a TaskResource that can be patched
+type taskField struct {
+	// check validates a new value of the field and returns it as it must be
+	// stored. The value is nil when the field was removed
+	check func(ctx *taskPatchContext, value interface{}) (interface{}, error)
+	// update writes the new value of the field
+	update func(tx *sqlx.Tx, ctx *taskPatchContext, value interface{}) error
+}
+
+// taskFields are the patchable fields of a TaskResource, by JSON name. Every
+// other field is read-only
+var taskFields = map[string]taskField{
+	"name": {
+		check: func(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+			name, ok := value.(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("must be a non-empty string")
+			}
+			return name, nil
+		},
+		update: execTaskStmt(&updateTasksName),
+	},
+	"description": {
+		check: func(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+			if value == nil {
+				return "", nil
+			}
+			description, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be a string")
+			}
+			return description, nil
+		},
+		update: execTaskStmt(&updateTasksDescription),
+	},
+	"progression": {
+		check: func(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+			if ctx.task.Subtasks > 0 {
+				return nil, fmt.Errorf("is derived from the subtasks")
+			}
+			progression, ok := value.(float64)
+			if !ok || progression != float64(int(progression)) {
+				return nil, fmt.Errorf("must be an integer")
+			}
+			return int(progression), nil
+		},
+		update: execTaskStmt(&updateTasksProgression),
+	},
+	"parent_id": {
+		check:  checkParentID,
+		update: updateParentID,
+	},
+	"weight": {
+		check: func(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+			weight, ok := value.(float64)
+			if !ok || weight != float64(int(weight)) || weight < 1 {
+				return nil, fmt.Errorf("must be a positive integer")
+			}
+			return int(weight), nil
+		},
+		update: execTaskStmt(&updateTasksWeight),
+	},
+	"due_at": {
+		check:  checkTime,
+		update: execTaskStmt(&updateTasksDueAt),
+	},
+	"start_at": {
+		check:  checkTime,
+		update: execTaskStmt(&updateTasksStartAt),
+	},
+	"labels": {
+		check: func(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+			if value == nil {
+				return pq.StringArray{}, nil
+			}
+			values, ok := value.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("must be an array of label names")
+			}
+			// Adding a label that the task already has is a no-op
+			labels := pq.StringArray{}
+			for _, v := range values {
+				label, ok := v.(string)
+				if !ok {
+					return nil, fmt.Errorf("must be an array of label names")
+				}
+				if !contains(labels, label) {
+					labels = append(labels, label)
+				}
+			}
+			var existing []string
+			if err := selectLabelNamesWhereName.Select(&existing, labels); err != nil {
+				log.Printf("couldn't select from labels: %v", err)
+				return nil, fmt.Errorf("couldn't check labels")
+			}
+			for _, label := range labels {
+				if !contains(existing, label) {
+					return nil, fmt.Errorf("unknown label %q", label)
+				}
+			}
+			return labels, nil
+		},
+		update: func(tx *sqlx.Tx, ctx *taskPatchContext, value interface{}) error {
+			if _, err := tx.Stmtx(deleteTaskLabels).Exec(ctx.task.ID); err != nil {
+				return err
+			}
+			_, err := tx.Stmtx(insertTaskLabels).Exec(ctx.task.ID, value)
+			return err
+		},
+	},
+	"project_id": {
+		check: func(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+			if value == nil {
+				// Personal tasks are out of the projects of restricted tokens
+				return nil, checkScope(ctx.user, projectScope(nil))
+			}
+			id, ok := value.(float64)
+			if !ok || id != float64(int(id)) {
+				return nil, fmt.Errorf("must be a project ID or null")
+			}
+			if err := checkAddToProject(int(id), ctx.user); err != nil {
+				return nil, err
+			}
+			return int(id), nil
+		},
+		update: func(tx *sqlx.Tx, ctx *taskPatchContext, value interface{}) error {
+			// The subtasks move along
+			var subtasks []TaskResource
+			if err := tx.Stmtx(selectTaskDescendants).Select(&subtasks, ctx.task.ID); err != nil {
+				return err
+			}
+			ctx.changed = append(ctx.changed, subtasks...)
+			_, err := tx.Stmtx(updateTasksProjectID).Exec(value, ctx.task.ID)
+			return err
+		},
+	},
+	"status": {
+		check: func(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+			status, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("must be a string")
+			}
+			if err := workflow.CheckTransition(ctx.task.Status, status, ctx.roles); err != nil {
+				return nil, err
+			}
+			return status, nil
+		},
+		update: func(tx *sqlx.Tx, ctx *taskPatchContext, value interface{}) error {
+			if _, err := tx.Stmtx(updateTasksStatus).Exec(value, ctx.task.ID); err != nil {
+				return err
+			}
+			if _, err := tx.Stmtx(bumpTaskVersionsWhereBlockerID).Exec(ctx.task.ID); err != nil {
+				return err
+			}
+			_, err := tx.Stmtx(insertTaskTransition).Exec(ctx.task.ID, ctx.user.ID, ctx.task.Status, value)
+			return err
+		},
+	},
+}
+
+// checkTime is the check of the optional date fields. Dates are RFC 3339
+// strings, and null clears them
+func checkTime(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("must be a RFC 3339 date or null")
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil, fmt.Errorf("must be a RFC 3339 date or null")
+	}
+	return t, nil
+}
+
+// checkTaskDates returns a *FieldError if a task starts after it's due
+func checkTaskDates(startAt, dueAt *time.Time) error {
+	if startAt != nil && dueAt != nil && startAt.After(*dueAt) {
+		return &FieldError{Field: "start_at", Message: "must not be after due_at"}
+	}
+	return nil
+}
+
+// documentTime returns the date of a field of a task document, or nil
+func documentTime(object map[string]interface{}, field string) *time.Time {
+	s, ok := object[field].(string)
+	if !ok {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+// execTaskStmt returns a taskField update function that executes stmt with the
+// value and the task ID. stmt is a pointer because statements are prepared
+// after taskFields is initialized
+func execTaskStmt(stmt **sqlx.Stmt) func(*sqlx.Tx, *taskPatchContext, interface{}) error {
+	return func(tx *sqlx.Tx, ctx *taskPatchContext, value interface{}) error {
+		_, err := tx.Stmtx(*stmt).Exec(value, ctx.task.ID)
+		return err
+	}
+}
+
+// taskDocument returns the JSON document of a task, as patches see it
+func taskDocument(task *TaskResource) (map[string]interface{}, error) {
+	b, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	var document map[string]interface{}
+	if err := json.Unmarshal(b, &document); err != nil {
+		return nil, err
+	}
+	// Omitted when empty, but it must exist to be replaced
+	if _, ok := document["description"]; !ok {
+		document["description"] = ""
+	}
+	return document, nil
+}
+
+// taskChange is the new value of a patched field
+type taskChange struct {
+	field string
+	value interface{}
+}
+
+// taskChanges compares the document of a task with its patched version and
+// returns the changes to store, in a stable order. It returns a *FieldError if
+// a read-only field was changed or if a patchable field is invalid
+func taskChanges(ctx *taskPatchContext, document map[string]interface{}, patched interface{}) ([]taskChange, error) {
+	object, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, &FieldError{Field: "", Message: "the document must be an object"}
+	}
+
+	var names []string
+	for name := range document {
+		names = append(names, name)
+	}
+	for name := range object {
+		if _, ok := document[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var changes []taskChange
+	for _, name := range names {
+		before, after := document[name], object[name]
+		if reflect.DeepEqual(before, after) {
+			continue
+		}
+		field, ok := taskFields[name]
+		if !ok {
+			if _, exists := document[name]; !exists {
+				return nil, &FieldError{Field: name, Message: "unknown field"}
+			}
+			return nil, &FieldError{Field: name, Message: "read-only field"}
+		}
+		value, err := field.check(ctx, after)
+		if err != nil {
+			return nil, &FieldError{Field: name, Message: err.Error()}
+		}
+		changes = append(changes, taskChange{field: name, value: value})
+	}
+	if err := checkTaskDates(documentTime(object, "start_at"), documentTime(object, "due_at")); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// taskChanges applies the patch to the document of a task and returns the
+// changes to store. Errors are *PatchError, pointing at the failing operation
+// or at the last operation that wrote an invalid field. An empty patch has no
+// operation to point at, so its errors are *FieldError
+func (patch JSONPatch) taskChanges(ctx *taskPatchContext, document map[string]interface{}) ([]taskChange, error) {
+	patched, err := patch.Apply(document)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := taskChanges(ctx, document, patched)
+	if err, ok := err.(*FieldError); ok && len(patch) > 0 {
+		i := patch.LastIndexTouching("/" + err.Field)
+		if i < 0 {
+			i = len(patch) - 1
+		}
+		return nil, &PatchError{Index: i, Op: patch[i].Op, Path: patch[i].Path, Message: err.Error()}
+	}
+	return changes, err
+}
+
+// applyTaskChanges writes the changes of a task in tx, then rolls up the
+// progression of its former and new parents. The other tasks it changes are
+// added to ctx. It returns a *FieldError if a change is invalid given the
+// other writes since the patch was checked
+func applyTaskChanges(tx *sqlx.Tx, ctx *taskPatchContext, changes []taskChange) error {
+	parents := []*int{ctx.task.ParentID}
+	rollup := false
+	for _, change := range changes {
+		if err := taskFields[change.field].update(tx, ctx, change.value); err != nil {
+			return err
+		}
+		switch change.field {
+		case "parent_id":
+			if change.value != nil {
+				parentID := change.value.(int)
+				parents = append(parents, &parentID)
+			}
+			rollup = true
+		case "progression", "weight":
+			rollup = true
+		}
+	}
+	if !rollup {
+		return nil
+	}
+	for _, parentID := range parents {
+		ancestors, err := rollupProgression(tx, parentID)
+		if err != nil {
+			return err
+		}
+		ctx.changed = append(ctx.changed, ancestors...)
+	}
+	return nil
+}
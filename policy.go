@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// roles are the roles a user can have on the workspace or on a project, from
+// the least to the most privileged. Each role has the permissions of the roles
+// before it
+var roles = []string{"viewer", "commenter", "editor", "admin", "owner"}
+
+// action is something a user can be allowed to do on the workspace, on a
+// project or on a task
+type action string
+
+const (
+	taskView        action = "task.view"
+	taskComment     action = "task.comment"
+	taskCreate      action = "task.create"
+	taskEdit        action = "task.edit"
+	projectView     action = "project.view"
+	projectCreate   action = "project.create"
+	projectAddTasks action = "project.add_tasks"
+	projectManage   action = "project.manage"
+	labelManage     action = "label.manage"
+	workspaceView   action = "workspace.view"
+	roleManage      action = "role.manage"
+	userManage      action = "user.manage"
+	clientManage    action = "client.manage"
+	auditRead       action = "audit.read"
+	webhookManage   action = "webhook.manage"
+)
+
+// policy is the least privileged role allowed to do each action. Every
+// permission check goes through it
+var policy = map[action]string{
+	taskView:        "viewer",
+	taskComment:     "commenter",
+	taskCreate:      "commenter",
+	taskEdit:        "editor",
+	projectView:     "viewer",
+	projectCreate:   "editor",
+	projectAddTasks: "editor",
+	projectManage:   "admin",
+	labelManage:     "admin",
+	workspaceView:   "viewer",
+	roleManage:      "admin",
+	userManage:      "admin",
+	clientManage:    "admin",
+	auditRead:       "admin",
+	webhookManage:   "admin",
+}
+
+// roleRank returns the position of a role in roles, or -1 for no role
+func roleRank(role string) int {
+	for i, r := range roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// allows tells whether a user with role can do an action
+func allows(role string, a action) bool {
+	required, ok := policy[a]
+	return ok && roleRank(role) >= 0 && roleRank(role) >= roleRank(required)
+}
+
+// canGrant tells whether a user with role can grant another role, or change or
+// revoke it. Nobody can grant a role above their own
+func canGrant(role, granted string) bool {
+	return allows(role, roleManage) && roleRank(granted) <= roleRank(role)
+}
+
+// canManageUser tells whether a user with role can manage the account of a
+// user whose workspace role is target. Nobody can manage a user above them
+func canManageUser(role, target string) bool {
+	return allows(role, userManage) && roleRank(target) <= roleRank(role)
+}
+
+// impliedRoles returns a role and the ones before it, e.g. to check the roles
+// listed by a workflow transition
+func impliedRoles(role string) []string {
+	rank := roleRank(role)
+	if rank < 0 {
+		return nil
+	}
+	return roles[:rank+1]
+}
+
+// checkRole returns a *FieldError unless role is one of roles
+func checkRole(role string) error {
+	if roleRank(role) < 0 {
+		return &FieldError{Field: "role", Message: fmt.Sprintf("must be one of %v", roles)}
+	}
+	return nil
+}
+
+// projectRole returns the role of a user on a project: the highest of their
+// workspace role and of their role in the project. Without a project, it
+// returns their workspace role. It is empty if they have none, or if their
+// token lacks the scope of the project
+func projectRole(user User, projectID *int) (string, error) {
+	if !user.scopes.has(projectScope(projectID)) {
+		return "", nil
+	}
+	var granted []string
+	if err := selectRoles.Select(&granted, user.ID, projectID); err != nil {
+		return "", err
+	}
+	role := ""
+	for _, r := range granted {
+		if roleRank(r) > roleRank(role) {
+			role = r
+		}
+	}
+	return role, nil
+}
+
+// taskRole returns the role of a user on a task. The creator of a task owns it.
+// The tasks of a project inherit the roles on the project, whereas personal
+// tasks, outside of any project, can only be edited by their creator: the
+// workspace role gives at most the commenter role on them
+func taskRole(user User, task *TaskResource) (string, error) {
+	if !user.scopes.has(projectScope(task.ProjectID)) {
+		return "", nil
+	}
+	if task.User.ID == user.ID {
+		return "owner", nil
+	}
+	role, err := projectRole(user, task.ProjectID)
+	if err != nil {
+		return "", err
+	}
+	if task.ProjectID == nil && roleRank(role) > roleRank("commenter") {
+		role = "commenter"
+	}
+	return role, nil
+}
+
+// authorize answers 403 Forbidden and returns false unless role allows an
+// action. err is the error of the selection of the role, if any
+func authorize(c *gin.Context, role string, err error, a action) bool {
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	if !allows(role, a) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// authorizeTask returns the role of a user on a task, if it allows an action
+// and their token has the scope of its project. It answers and returns false
+// otherwise
+func authorizeTask(c *gin.Context, user User, task *TaskResource, a action) (string, bool) {
+	if !authorizeScope(c, user, projectScope(task.ProjectID)) {
+		return "", false
+	}
+	role, err := taskRole(user, task)
+	return role, authorize(c, role, err, a)
+}
+
+// authorizeProject returns the role of a user on a project, if it allows an
+// action and their token has the scope of the project. It answers and returns
+// false otherwise
+func authorizeProject(c *gin.Context, user User, projectID int, a action) (string, bool) {
+	if !authorizeScope(c, user, projectScope(&projectID)) {
+		return "", false
+	}
+	role, err := projectRole(user, &projectID)
+	return role, authorize(c, role, err, a)
+}
+
+// authorizeWorkspace returns the workspace role of a user, if it allows an
+// action and their token isn't restricted to projects. It answers and returns
+// false otherwise
+func authorizeWorkspace(c *gin.Context, user User, a action) (string, bool) {
+	if !authorizeScope(c, user, projectScope(nil)) {
+		return "", false
+	}
+	role, err := projectRole(user, nil)
+	return role, authorize(c, role, err, a)
+}
+
+// authUser returns the authenticated user. It answers and returns false if
+// there is none, which means the route misses the authMiddleware
+func authUser(c *gin.Context) (User, bool) {
+	user, exists := c.Get(gin.AuthUserKey)
+	if !exists {
+		log.Printf("No user in %s %s handler context", c.Request.Method, c.Request.URL.Path)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return User{}, false
+	}
+	return user.(User), true
+}
+
+// selectAuthorizedTask selects the task of the id parameter, and checks that
+// the authenticated user can do an action on it. It returns the role of the
+// user, or answers and returns false
+func selectAuthorizedTask(c *gin.Context, task *TaskResource, a action) (string, bool) {
+	user, ok := authUser(c)
+	if !ok {
+		return "", false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return "", false
+	}
+
+	err = selectTaskWhereID.Get(task, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return "", false
+	}
+	if err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return "", false
+	}
+	return authorizeTask(c, user, task, a)
+}
+
+// visibleTasks restricts a task query to the tasks that the user can view, if
+// their workspace role doesn't let them view every task, and to the projects of
+// their token if it is restricted to projects
+func visibleTasks(c *gin.Context, query *taskQuery) bool {
+	user, ok := authUser(c)
+	if !ok {
+		return false
+	}
+	// The scopes of the token restrict the projects below, not the role
+	role, err := projectRole(User{Model: user.Model}, nil)
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	if !allows(role, taskView) {
+		query.Where("(tasks.user_id = ? OR tasks.project_id IN (SELECT project_id FROM project_members WHERE user_id = ?))", user.ID, user.ID)
+	}
+	if projects := user.scopes.projects(); len(projects) > 0 {
+		query.Where("tasks.project_id = ANY(?)", pq.Array(projects))
+	}
+	return true
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// checkAddToProject returns an error unless user can add tasks to the project.
+// It is a *ScopeError if their token lacks the scope of the project
+func checkAddToProject(projectID int, user User) error {
+	if err := checkScope(user, projectScope(&projectID)); err != nil {
+		return err
+	}
+	var project ProjectResource
+	err := selectProjectWhereID.Get(&project, projectID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("project %d doesn't exist", projectID)
+	}
+	if err != nil {
+		log.Printf("couldn't select from projects: %v", err)
+		return fmt.Errorf("couldn't check the project")
+	}
+	role, err := projectRole(user, &projectID)
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		return fmt.Errorf("couldn't check the project")
+	}
+	if !allows(role, projectAddTasks) {
+		return fmt.Errorf("only editors of project %d can add tasks to it", projectID)
+	}
+	return nil
+}
+
+// selectProject selects the project of the id parameter, and checks that the
+// authenticated user can do an action on it. It returns the role of the user,
+// or answers and returns false
+func selectProject(c *gin.Context, project *ProjectResource, a action) (string, bool) {
+	user, ok := authUser(c)
+	if !ok {
+		return "", false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return "", false
+	}
+
+	err = selectProjectWhereID.Get(project, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return "", false
+	}
+	if err != nil {
+		log.Printf("couldn't select from projects: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return "", false
+	}
+	return authorizeProject(c, user, project.ID, a)
+}
+
+// getProjectsHandler lists the projects that the authenticated user can view,
+// among the projects of their token if it is restricted to projects
+func getProjectsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	role, err := projectRole(User{Model: user.Model}, nil)
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	var projects []ProjectResource
+	if err := selectProjects.Select(&projects, allows(role, projectView), user.ID); err != nil {
+		log.Printf("couldn't select from projects: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if len(user.scopes.projects()) > 0 {
+		var scoped []ProjectResource
+		for _, project := range projects {
+			if user.scopes.has(projectScope(&project.ID)) {
+				scoped = append(scoped, project)
+			}
+		}
+		projects = scoped
+	}
+
+	c.JSON(http.StatusOK, projects)
+}
+
+func getProjectsIDHandler(c *gin.Context) {
+	var project ProjectResource
+	if _, ok := selectProject(c, &project, projectView); !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, project)
+}
+
+// postProjectsHandler creates a project. Its creator is its owner and its
+// first member
+func postProjectsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, projectCreate); !ok {
+		return
+	}
+
+	var project Project
+	if err := c.BindJSON(&project); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	// The owner isn't the client's to choose
+	project.OwnerID = user.ID
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var projectID int
+	if err := tx.Stmtx(insertProject).Get(&projectID, project.Name, project.Description, project.OwnerID); err != nil {
+		log.Printf("couldn't insert to projects: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(insertProjectMember).Exec(projectID, project.OwnerID, "owner"); err != nil {
+		log.Printf("couldn't insert to project_members: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var created ProjectResource
+	if err := tx.Stmtx(selectProjectWhereID).Get(&created, projectID); err != nil {
+		log.Printf("couldn't select from projects: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "create", "/projects/"+strconv.Itoa(projectID), nil, created, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", "/projects/"+strconv.Itoa(projectID))
+	c.Data(http.StatusCreated, "", nil)
+}
+
+// patchProjectsIDHandler applies a JSON Merge Patch to a project
+func patchProjectsIDHandler(c *gin.Context) {
+	var project ProjectResource
+	if _, ok := selectProject(c, &project, projectManage); !ok {
+		return
+	}
+
+	var changed Project
+	if !bindMergePatch(c, &project, []string{"name", "description"}, &changed) {
+		return
+	}
+	if changed.Name == "" {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "name", Message: "must be a non-empty string"})
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmtx(updateProject).Exec(changed.Name, changed.Description, project.ID); err != nil {
+		log.Printf("couldn't update projects: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var after ProjectResource
+	if err := tx.Stmtx(selectProjectWhereID).Get(&after, project.ID); err != nil {
+		log.Printf("couldn't select from projects: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "update", "/projects/"+strconv.Itoa(project.ID), project, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+func getProjectsIDMembersHandler(c *gin.Context) {
+	var project ProjectResource
+	if _, ok := selectProject(c, &project, projectView); !ok {
+		return
+	}
+
+	var members []MemberResource
+	if err := selectProjectMembers.Select(&members, project.ID); err != nil {
+		log.Printf("couldn't select from project_members: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// postProjectsIDMembersHandler adds a member to a project, as an editor unless
+// another role is given
+func postProjectsIDMembersHandler(c *gin.Context) {
+	var project ProjectResource
+	role, ok := selectProject(c, &project, projectManage)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		UserID int    `json:"user_id" binding:"required"`
+		Role   string `json:"role"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if body.Role == "" {
+		body.Role = "editor"
+	}
+	if err := checkRole(body.Role); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if !canGrant(role, body.Role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Stmtx(insertProjectMember).Exec(project.ID, body.UserID, body.Role)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "user_id", Message: fmt.Sprintf("user %d doesn't exist", body.UserID)})
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't insert to project_members: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	member := gin.H{"user_id": body.UserID, "role": body.Role}
+	if err := audit(c, tx, "create", "/projects/"+strconv.Itoa(project.ID)+"/members/"+strconv.Itoa(body.UserID), nil, member, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusCreated, "", nil)
+}
+
+// selectMemberRole selects the role of the user_id parameter in a project. It
+// answers and returns false if they aren't a member, or if the authenticated
+// user, whose role is role, can't change it
+func selectMemberRole(c *gin.Context, project *ProjectResource, role string) (int, string, bool) {
+	memberID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return 0, "", false
+	}
+	var memberRole string
+	err = selectProjectMemberRole.Get(&memberRole, project.ID, memberID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return 0, "", false
+	}
+	if err != nil {
+		log.Printf("couldn't select from project_members: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return 0, "", false
+	}
+	if !canGrant(role, memberRole) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return 0, "", false
+	}
+	return memberID, memberRole, true
+}
+
+// putProjectsIDMembersUserIDHandler changes the role of a member of a project.
+// The owner of the project keeps the owner role
+func putProjectsIDMembersUserIDHandler(c *gin.Context) {
+	var project ProjectResource
+	role, ok := selectProject(c, &project, projectManage)
+	if !ok {
+		return
+	}
+	memberID, memberRole, ok := selectMemberRole(c, &project, role)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if err := checkRole(body.Role); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if !canGrant(role, body.Role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	if memberID == project.Owner.ID && body.Role != "owner" {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "role", Message: "the owner of the project must keep the owner role"})
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmtx(updateProjectMemberRole).Exec(project.ID, memberID, body.Role); err != nil {
+		log.Printf("couldn't update project_members: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	before := gin.H{"user_id": memberID, "role": memberRole}
+	after := gin.H{"user_id": memberID, "role": body.Role}
+	if err := audit(c, tx, "update", "/projects/"+strconv.Itoa(project.ID)+"/members/"+strconv.Itoa(memberID), before, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// deleteProjectsIDMembersUserIDHandler removes a member from a project.
+// Managers can remove the members whose role isn't above theirs, and members
+// can leave
+func deleteProjectsIDMembersUserIDHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var project ProjectResource
+	if c.Param("user_id") == strconv.Itoa(user.ID) {
+		if _, ok := selectProject(c, &project, projectView); !ok {
+			return
+		}
+	} else {
+		role, ok := selectProject(c, &project, projectManage)
+		if !ok {
+			return
+		}
+		if _, _, ok := selectMemberRole(c, &project, role); !ok {
+			return
+		}
+	}
+	memberID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if memberID == project.Owner.ID {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "user_id", Message: "the owner can't leave the project"})
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var memberRole string
+	err = tx.Stmtx(deleteProjectMember).Get(&memberRole, project.ID, memberID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't delete from project_members: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	member := gin.H{"user_id": memberID, "role": memberRole}
+	if err := audit(c, tx, "delete", "/projects/"+strconv.Itoa(project.ID)+"/members/"+strconv.Itoa(memberID), member, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+func getProjectsIDTasksHandler(c *gin.Context) {
+	var project ProjectResource
+	if _, ok := selectProject(c, &project, projectView); !ok {
+		return
+	}
+
+	listTasks(c, func(query *taskQuery) {
+		query.Where("tasks.project_id = ?", project.ID)
+	})
+}
+
+// postProjectsIDTasksHandler moves tasks to a project, along with their
+// subtasks. The user must be able to edit every task and to add tasks to the
+// project. Either every task is moved or none is
+func postProjectsIDTasksHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var project ProjectResource
+	if _, ok := selectProject(c, &project, projectAddTasks); !ok {
+		return
+	}
+
+	var body struct {
+		TaskIDs []int `json:"task_ids" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	tasks := make([]TaskResource, len(body.TaskIDs))
+	for i, taskID := range body.TaskIDs {
+		task := &tasks[i]
+		err := selectTaskWhereID.Get(task, taskID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: "task_ids", Message: fmt.Sprintf("task %d doesn't exist", taskID)})
+			return
+		}
+		if err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if _, ok := authorizeTask(c, user, task, taskEdit); !ok {
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	// The subtasks move along
+	moved := map[int]bool{}
+	for _, task := range tasks {
+		moved[task.ID] = true
+	}
+	var subtasks []TaskResource
+	for _, task := range tasks {
+		var descendants []TaskResource
+		if err := tx.Stmtx(selectTaskDescendants).Select(&descendants, task.ID); err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		for _, subtask := range descendants {
+			if !moved[subtask.ID] {
+				subtasks = append(subtasks, subtask)
+			}
+		}
+	}
+	for _, task := range tasks {
+		if _, err := tx.Stmtx(updateTasksProjectID).Exec(project.ID, task.ID); err != nil {
+			log.Printf("couldn't update tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	// The changes are recorded after every write, see taskEventsLockID
+	for _, task := range tasks {
+		var after TaskResource
+		if err := tx.Stmtx(selectTaskWhereID).Get(&after, task.ID); err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if err := audit(c, tx, "update", "/tasks/"+strconv.Itoa(task.ID), task, after, nil); err != nil {
+			log.Printf("couldn't insert to audit_log: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := auditTasks(c, tx, subtasks); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 500
+)
+
+// ParamError is returned when a query string parameter is invalid
+type ParamError struct {
+	Param   string `json:"param"`
+	Message string `json:"message"`
+}
+
+func (e *ParamError) Error() string {
+	return fmt.Sprintf("invalid %q parameter: %s", e.Param, e.Message)
+}
+
+// sqlQuery accumulates the WHERE clauses of a query and their arguments.
+// Clauses use ? placeholders, which are rebound for PostgreSQL by sqlx, so that
+// values are never interpolated in the query
+type sqlQuery struct {
+	where []string
+	args  []interface{}
+}
+
+// Where adds a clause to the query. Clauses are joined with AND
+func (q *sqlQuery) Where(clause string, args ...interface{}) {
+	q.where = append(q.where, clause)
+	q.args = append(q.args, args...)
+}
+
+// WhereClause returns the WHERE clause of the query, or an empty string
+func (q *sqlQuery) WhereClause() string {
+	if len(q.where) == 0 {
+		return ""
+	}
+	return "\n\t\tWHERE " + strings.Join(q.where, " AND ")
+}
+
+// taskSortKey describes a TaskResource field that tasks can be sorted on
+type taskSortKey struct {
+	expr  string
+	cast  string
+	value func(*TaskResource) string
+}
+
+func formatTime(t time.Time) string { return t.Format(time.RFC3339Nano) }
+
+// formatOptionalTime formats a nullable date, which sorts after every other
+func formatOptionalTime(t *time.Time) string {
+	if t == nil {
+		return "infinity"
+	}
+	return formatTime(*t)
+}
+
+// taskSortKeys maps the sortable TaskResource fields to their SQL expression
+var taskSortKeys = map[string]taskSortKey{
+	"id":            {"tasks.id", "integer", func(t *TaskResource) string { return strconv.Itoa(t.ID) }},
+	"created_at":    {"tasks.created_at", "timestamptz", func(t *TaskResource) string { return formatTime(t.CreatedAt) }},
+	"updated_at":    {"tasks.updated_at", "timestamptz", func(t *TaskResource) string { return formatTime(t.UpdatedAt) }},
+	"name":          {"tasks.name", "text", func(t *TaskResource) string { return t.Name }},
+	"description":   {"COALESCE(tasks.description, '')", "text", func(t *TaskResource) string { return t.Description }},
+	"progression":   {"tasks.progression", "integer", func(t *TaskResource) string { return strconv.Itoa(t.Progression) }},
+	"status":        {"tasks.status", "text", func(t *TaskResource) string { return t.Status }},
+	"due_at":        {"COALESCE(tasks.due_at, 'infinity')", "timestamptz", func(t *TaskResource) string { return formatOptionalTime(t.DueAt) }},
+	"start_at":      {"COALESCE(tasks.start_at, 'infinity')", "timestamptz", func(t *TaskResource) string { return formatOptionalTime(t.StartAt) }},
+	"user.id":       {"users.id", "integer", func(t *TaskResource) string { return strconv.Itoa(t.User.ID) }},
+	"user.username": {"users.username", "text", func(t *TaskResource) string { return t.User.Username }},
+}
+
+// cursor is the position of a page in a keyset pagination. It holds the sort
+// value and the ID of the last task of the previous page
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func (cur cursor) String() string {
+	b, _ := json.Marshal(cur)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCursor(s string) (cursor, error) {
+	var cur cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cur, err
+	}
+	err = json.Unmarshal(b, &cur)
+	return cur, err
+}
+
+// taskQuery is a filtered, sorted and paginated selection of tasks. Unless
+// deleted is set, only tasks that aren't in the trash are selected
+type taskQuery struct {
+	sqlQuery
+	sort    string
+	desc    bool
+	limit   int
+	cursor  *cursor
+	deleted bool
+}
+
+// parseTaskQuery builds a taskQuery from the query string. The supported
+// parameters are limit, cursor, sort, user_id, status, label, label_match,
+// blocked, overdue, progression_min, progression_max, created_after,
+// created_before, updated_after, updated_before, due_after, due_before,
+// start_after and start_before
+func parseTaskQuery(c *gin.Context) (*taskQuery, error) {
+	q := &taskQuery{sort: "created_at", desc: true, limit: defaultLimit}
+
+	if v, ok := c.GetQuery("limit"); ok {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return nil, &ParamError{"limit", fmt.Sprintf("must be an integer between 1 and %d", maxLimit)}
+		}
+		q.limit = limit
+	}
+
+	if v, ok := c.GetQuery("sort"); ok {
+		q.desc = strings.HasPrefix(v, "-")
+		q.sort = strings.TrimPrefix(v, "-")
+		if _, ok := taskSortKeys[q.sort]; !ok {
+			return nil, &ParamError{"sort", fmt.Sprintf("unknown field %q", q.sort)}
+		}
+	}
+
+	if v, ok := c.GetQuery("user_id"); ok {
+		userID, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, &ParamError{"user_id", "must be an integer"}
+		}
+		q.Where("tasks.user_id = ?", userID)
+	}
+
+	if v, ok := c.GetQuery("status"); ok {
+		statuses := strings.Split(v, ",")
+		for _, status := range statuses {
+			if !workflow.HasState(status) {
+				return nil, &ParamError{"status", fmt.Sprintf("unknown status %q", status)}
+			}
+		}
+		q.Where("tasks.status = ANY(?)", pq.StringArray(statuses))
+	}
+
+	// label can be repeated or hold several comma separated labels. Tasks
+	// match if they have any of the labels, or all of them with label_match=all
+	var labels pq.StringArray
+	for _, v := range c.Request.URL.Query()["label"] {
+		for _, label := range strings.Split(v, ",") {
+			if label != "" && !contains(labels, label) {
+				labels = append(labels, label)
+			}
+		}
+	}
+	if len(labels) > 0 {
+		const hasLabels = "SELECT count(*) FROM task_labels JOIN labels ON task_labels.label_id = labels.id WHERE task_labels.task_id = tasks.id AND labels.name = ANY(?)"
+		switch c.DefaultQuery("label_match", "any") {
+		case "any":
+			q.Where("("+hasLabels+") > 0", labels)
+		case "all":
+			q.Where("("+hasLabels+") = ?", labels, len(labels))
+		default:
+			return nil, &ParamError{"label_match", "must be any or all"}
+		}
+	}
+
+	if v, ok := c.GetQuery("blocked"); ok {
+		blocked, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, &ParamError{"blocked", "must be a boolean"}
+		}
+		clause := fmt.Sprintf(blockedTasks, "?")
+		if !blocked {
+			clause = "NOT " + clause
+		}
+		q.Where(clause, workflow.FinalStatuses())
+	}
+
+	// A task is overdue when its due date is past and it isn't in a final
+	// status
+	if v, ok := c.GetQuery("overdue"); ok {
+		overdue, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, &ParamError{"overdue", "must be a boolean"}
+		}
+		if overdue {
+			q.Where("(tasks.due_at < now() AND tasks.status <> ALL(?))", workflow.FinalStatuses())
+		} else {
+			q.Where("(tasks.due_at IS NULL OR tasks.due_at >= now() OR tasks.status = ANY(?))", workflow.FinalStatuses())
+		}
+	}
+
+	for _, param := range []struct{ name, clause string }{
+		{"progression_min", "tasks.progression >= ?"},
+		{"progression_max", "tasks.progression <= ?"},
+	} {
+		if v, ok := c.GetQuery(param.name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, &ParamError{param.name, "must be an integer"}
+			}
+			q.Where(param.clause, n)
+		}
+	}
+
+	for _, param := range []struct{ name, clause string }{
+		{"created_after", "tasks.created_at > ?"},
+		{"created_before", "tasks.created_at < ?"},
+		{"updated_after", "tasks.updated_at > ?"},
+		{"updated_before", "tasks.updated_at < ?"},
+		{"due_after", "tasks.due_at > ?"},
+		{"due_before", "tasks.due_at < ?"},
+		{"start_after", "tasks.start_at > ?"},
+		{"start_before", "tasks.start_at < ?"},
+	} {
+		if v, ok := c.GetQuery(param.name); ok {
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, &ParamError{param.name, "must be a RFC 3339 date"}
+			}
+			q.Where(param.clause, t)
+		}
+	}
+
+	if v, ok := c.GetQuery("cursor"); ok {
+		cur, err := parseCursor(v)
+		if err != nil {
+			return nil, &ParamError{"cursor", "malformed cursor"}
+		}
+		if cur.Sort != q.sortParam() {
+			return nil, &ParamError{"cursor", "cursor was issued for another sort order"}
+		}
+		q.cursor = &cur
+	}
+
+	return q, nil
+}
+
+// sortParam returns the sort parameter of the query, as it appears in URLs
+func (q *taskQuery) sortParam() string {
+	if q.desc {
+		return "-" + q.sort
+	}
+	return q.sort
+}
+
+// deletedClause restricts the selection to the tasks in the trash, or to the
+// ones that aren't
+func (q *taskQuery) deletedClause() string {
+	if q.deleted {
+		return "tasks.deleted_at IS NOT NULL"
+	}
+	return "tasks.deleted_at IS NULL"
+}
+
+// Validators returns the cache validators of the selection, regardless of
+// pagination. Every filtered task counts in last_modified, whether it's
+// deleted or not, so that moving a task to or from the trash changes it
+func (q *taskQuery) Validators() (*collectionValidators, error) {
+	query := fmt.Sprintf(`SELECT count(*) FILTER (WHERE %s) AS count, max(GREATEST(tasks.updated_at, users.updated_at)) AS last_modified
+		%s`, q.deletedClause(), fromTasks) + q.WhereClause()
+	var validators collectionValidators
+	err := db.Get(&validators, db.Rebind(query), q.args...)
+	return &validators, err
+}
+
+// Select returns the page of tasks selected by the query, and the cursor of
+// the next page if there is one
+func (q *taskQuery) Select() ([]TaskResource, *cursor, error) {
+	key := taskSortKeys[q.sort]
+	direction, comparison := "ASC", ">"
+	if q.desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	where := q.sqlQuery
+	where.Where(q.deletedClause())
+	if q.cursor != nil {
+		where.Where(fmt.Sprintf("(%s, tasks.id) %s (?::%s, ?)", key.expr, comparison, key.cast), q.cursor.Value, q.cursor.ID)
+	}
+	query := selectTaskResources + where.WhereClause() +
+		fmt.Sprintf("\n\t\tORDER BY %s %s, tasks.id %s\n\t\tLIMIT ?", key.expr, direction, direction)
+	args := append(where.args, q.limit+1)
+
+	var tasks []TaskResource
+	if err := db.Select(&tasks, db.Rebind(query), args...); err != nil {
+		return nil, nil, err
+	}
+	if len(tasks) <= q.limit {
+		return tasks, nil, nil
+	}
+	tasks = tasks[:q.limit]
+	last := &tasks[len(tasks)-1]
+	return tasks, &cursor{Sort: q.sortParam(), Value: key.value(last), ID: last.ID}, nil
+}
+
+// setLinkHeader sets a RFC 5988 Link header with the first and next pages
+func setLinkHeader(c *gin.Context, next *cursor) {
+	link := func(cur *cursor, rel string) string {
+		u := *c.Request.URL
+		values := u.Query()
+		values.Del("cursor")
+		if cur != nil {
+			values.Set("cursor", cur.String())
+		}
+		u.RawQuery = values.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel)
+	}
+
+	links := []string{link(nil, "first")}
+	if next != nil {
+		links = append(links, link(next, "next"))
+	}
+	c.Header("Link", strings.Join(links, ", "))
+}
+
+// listTasks answers a paginated list of the tasks that the authenticated user
+// can view. extra restricts the selection further, e.g. to the tasks of a user
+func listTasks(c *gin.Context, extra func(*taskQuery)) {
+	query, err := parseTaskQuery(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if extra != nil {
+		extra(query)
+	}
+	if !visibleTasks(c, query) {
+		return
+	}
+
+	validators, err := query.Validators()
+	if err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if notModified(c, validators.Etag(c), validators.LastModified.Time) {
+		return
+	}
+
+	tasks, next, err := query.Select()
+	if err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	setLinkHeader(c, next)
+	c.JSON(http.StatusOK, tasks)
+}
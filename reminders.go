@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// reminderWindow is how late a due reminder can still be sent, e.g. after
+// every instance was down for a while
+const reminderWindow = 24 * time.Hour
+
+// ReminderEvent is the data of a task.reminder event. Kind is "upcoming" when
+// the task will soon be due, and "due" when it is
+type ReminderEvent struct {
+	Kind  string       `json:"kind"`
+	DueAt time.Time    `json:"due_at"`
+	Task  TaskResource `json:"task"`
+}
+
+// reminder is a reminder that is yet to be sent to a sink
+type reminder struct {
+	TaskID int       `db:"task_id"`
+	DueAt  time.Time `db:"due_at"`
+}
+
+// sendReminders sends the upcoming reminders of the tasks due within lead of
+// now, and the due reminders of the tasks due before now, to every sink. Tasks
+// in a final status get no reminder
+func sendReminders(now time.Time, lead time.Duration, sinks []EventSink) {
+	kinds := []struct {
+		kind     string
+		from, to time.Time
+	}{
+		{"upcoming", now, now.Add(lead)},
+		{"due", now.Add(-reminderWindow), now},
+	}
+	for _, sink := range sinks {
+		for _, k := range kinds {
+			if !k.to.After(k.from) {
+				continue
+			}
+			var reminders []reminder
+			if err := selectPendingReminders.Select(&reminders, k.from, k.to, workflow.FinalStatuses(), k.kind, sink.Name()); err != nil {
+				log.Printf("couldn't select from reminders: %v", err)
+				return
+			}
+			for _, r := range reminders {
+				if err := sendReminder(sink, k.kind, r); err != nil {
+					log.Printf("couldn't send %s reminder of task %d to %s: %v", k.kind, r.TaskID, sink.Name(), err)
+				}
+			}
+		}
+	}
+}
+
+// sendReminder claims a reminder, then sends it. The claim is unique and is
+// committed before the reminder is sent, so when several instances send the
+// same reminder only one of them claims it and the others skip it. The claim
+// is marked sent once the sink succeeds, and released if it fails so that the
+// reminder is sent again later. A reminder whose instance stopped while
+// sending it stays claimed, so that it is never sent twice
+func sendReminder(sink EventSink, kind string, r reminder) error {
+	var id int
+	err := claimReminder.Get(&id, r.TaskID, kind, r.DueAt, sink.Name())
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var task TaskResource
+	err = selectTaskWhereID.Get(&task, r.TaskID)
+	if err != nil && err != sql.ErrNoRows {
+		unclaimReminder(id)
+		return err
+	}
+	// The task was deleted or changed since the reminder was selected
+	if err == sql.ErrNoRows || task.DueAt == nil || !task.DueAt.Equal(r.DueAt) || workflow.IsFinal(task.Status) {
+		unclaimReminder(id)
+		return nil
+	}
+
+	event := Event{Type: "task.reminder", Time: time.Now(), Data: ReminderEvent{Kind: kind, DueAt: r.DueAt, Task: task}}
+	if err := sink.Send(event); err != nil {
+		unclaimReminder(id)
+		return err
+	}
+	_, err = markReminderSent.Exec(id)
+	return err
+}
+
+// unclaimReminder deletes the claim of a reminder that wasn't sent
+func unclaimReminder(id int) {
+	if _, err := releaseReminder.Exec(id); err != nil {
+		log.Printf("couldn't delete from reminders: %v", err)
+	}
+}
+
+// sendRemindersEvery calls sendReminders periodically. It never returns
+func sendRemindersEvery(interval, lead time.Duration, sinks []EventSink) {
+	for {
+		sendReminders(time.Now(), lead, sinks)
+		time.Sleep(interval)
+	}
+}
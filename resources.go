@@ -1,9 +1,10 @@
 package main
 
 import (
-	"crypto/md5"
-	"fmt"
+	"encoding/json"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // Resource is a base resource with fields common to all resources
@@ -18,20 +19,169 @@ type UserResource struct {
 	Username string `json:"username"`
 }
 
+// ProfileResource is a resource that represents the profile of a user
+type ProfileResource struct {
+	UserResource
+	CreatedAt     time.Time  `db:"created_at" json:"created_at"`
+	Name          string     `json:"name"`
+	DeactivatedAt *time.Time `db:"deactivated_at" json:"deactivated_at"`
+}
+
+// SessionResource is a resource that represents the login session of a user.
+// Requests authenticated by the session must send its CSRF token in the
+// X-CSRF-Token header, unless they are safe
+type SessionResource struct {
+	User      ProfileResource `json:"user"`
+	CSRFToken string          `db:"csrf_token" json:"csrf_token"`
+	ExpiresAt time.Time       `db:"expires_at" json:"expires_at"`
+}
+
+// TokenResource is a resource that represents an API token. The token itself
+// is only known when it's minted
+type TokenResource struct {
+	Resource
+	Name       string         `json:"name"`
+	Scopes     pq.StringArray `json:"scopes"`
+	CreatedAt  time.Time      `db:"created_at" json:"created_at"`
+	LastUsedAt *time.Time     `db:"last_used_at" json:"last_used_at"`
+	ExpiresAt  *time.Time     `db:"expires_at" json:"expires_at"`
+	RevokedAt  *time.Time     `db:"revoked_at" json:"revoked_at"`
+}
+
+// ClientResource is a resource that represents an OAuth client. Its secret, if
+// it isn't public, is only known when it's registered
+type ClientResource struct {
+	Resource
+	ClientID     string         `db:"client_id" json:"client_id"`
+	Name         string         `json:"name"`
+	RedirectURIs pq.StringArray `db:"redirect_uris" json:"redirect_uris"`
+	Public       bool           `json:"public"`
+	Scopes       pq.StringArray `json:"scopes"`
+	CreatedAt    time.Time      `db:"created_at" json:"created_at"`
+	RevokedAt    *time.Time     `db:"revoked_at" json:"revoked_at"`
+}
+
+// AuditEntryResource is a resource that represents an entry of the audit log.
+// Path is the path of the changed resource. Before and After are the values of
+// the resource around the change, and Patch is the patch document that changed
+// it, if any
+type AuditEntryResource struct {
+	Resource
+	CreatedAt time.Time        `db:"created_at" json:"created_at"`
+	ActorID   *int             `db:"actor_id" json:"actor_id"`
+	RequestID *string          `db:"request_id" json:"request_id"`
+	Action    string           `json:"action"`
+	Path      string           `db:"resource" json:"resource"`
+	Before    *json.RawMessage `json:"before"`
+	After     *json.RawMessage `json:"after"`
+	Patch     *json.RawMessage `json:"patch"`
+}
+
+// TaskRevisionResource is a resource that represents a revision of a task,
+// i.e. an entry of the audit log about it. Changes is the diff of the task
+type TaskRevisionResource struct {
+	Resource
+	CreatedAt time.Time        `db:"created_at" json:"created_at"`
+	ActorID   *int             `db:"actor_id" json:"actor_id"`
+	RequestID *string          `db:"request_id" json:"request_id"`
+	Action    string           `json:"action"`
+	Changes   []FieldChange    `db:"-" json:"changes"`
+	Patch     *json.RawMessage `json:"patch"`
+	Before    *json.RawMessage `json:"-"`
+	After     *json.RawMessage `json:"-"`
+}
+
+// TaskEventResource is a resource that represents a change of a task, or of
+// its comments or dependencies, as streamed by GET /events. UserID is the
+// creator of the task, and Data is the changed resource, as it was before
+// being deleted if it was
+type TaskEventResource struct {
+	Resource
+	CreatedAt time.Time        `db:"created_at" json:"created_at"`
+	Type      string           `json:"type"`
+	Path      string           `db:"resource" json:"resource"`
+	TaskID    int              `db:"task_id" json:"task_id"`
+	UserID    int              `db:"user_id" json:"user_id"`
+	ProjectID *int             `db:"project_id" json:"project_id"`
+	ActorID   *int             `db:"actor_id" json:"actor_id"`
+	Data      *json.RawMessage `json:"data"`
+}
+
+// WebhookResource is a resource that represents a webhook. Its secret is only
+// known when it's created
+type WebhookResource struct {
+	Resource
+	CreatedAt time.Time      `db:"created_at" json:"created_at"`
+	UserID    int            `db:"user_id" json:"user_id"`
+	ProjectID *int           `db:"project_id" json:"project_id"`
+	URL       string         `json:"url"`
+	Events    pq.StringArray `json:"events"`
+}
+
+// WebhookDeliveryResource is a resource that represents the delivery of an
+// event to a webhook, with the log of its attempts
+type WebhookDeliveryResource struct {
+	Resource
+	CreatedAt     time.Time                `db:"created_at" json:"created_at"`
+	EventID       int                      `db:"event_id" json:"event_id"`
+	EventType     string                   `db:"event_type" json:"event_type"`
+	Attempts      int                      `json:"attempts"`
+	NextAttemptAt *time.Time               `db:"next_attempt_at" json:"next_attempt_at"`
+	DeliveredAt   *time.Time               `db:"delivered_at" json:"delivered_at"`
+	FailedAt      *time.Time               `db:"failed_at" json:"failed_at"`
+	Log           []WebhookAttemptResource `db:"-" json:"log"`
+}
+
+// WebhookAttemptResource is a resource that represents an attempt to deliver
+// an event to a webhook. StatusCode is null if the request failed, e.g. if it
+// timed out
+type WebhookAttemptResource struct {
+	DeliveryID  int       `db:"delivery_id" json:"-"`
+	AttemptedAt time.Time `db:"attempted_at" json:"attempted_at"`
+	StatusCode  *int      `db:"status_code" json:"status_code"`
+	Error       *string   `json:"error"`
+	DurationMS  int       `db:"duration_ms" json:"duration_ms"`
+}
+
+// FieldChange is the change of a field of a resource
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// MemberResource is a resource that represents a user and their role, on the
+// workspace or on a project
+type MemberResource struct {
+	UserResource
+	Role string `json:"role"`
+}
+
 // TaskResource is a resource that represents a task. It embeds a UserResource
 type TaskResource struct {
 	Resource
-	CreatedAt   time.Time    `db:"created_at" json:"created_at"`
-	UpdatedAt   time.Time    `db:"updated_at" json:"updated_at"`
-	User        UserResource `json:"user"`
-	Name        string       `json:"name"`
-	Description string       `json:"description,omitempty"`
-	Progression int          `json:"progression"`
+	CreatedAt   time.Time      `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time      `db:"updated_at" json:"updated_at"`
+	DeletedAt   *time.Time     `db:"deleted_at" json:"deleted_at,omitempty"`
+	User        UserResource   `json:"user"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Progression int            `json:"progression"`
+	Status      string         `json:"status"`
+	DueAt       *time.Time     `db:"due_at" json:"due_at"`
+	StartAt     *time.Time     `db:"start_at" json:"start_at"`
+	Labels      pq.StringArray `json:"labels"`
+	ParentID    *int           `db:"parent_id" json:"parent_id"`
+	ProjectID   *int           `db:"project_id" json:"project_id"`
+	Weight      int            `json:"weight"`
+	Subtasks    int            `json:"subtasks"`
+	Blocked     bool           `json:"blocked"`
+	Version     int            `json:"-"`
 }
 
-// Etag returns the Etag for the resource
+// Etag returns the strong Etag of the resource, derived from its version
 func (task *TaskResource) Etag() string {
-	return fmt.Sprintf("%x", md5.Sum([]byte(fmt.Sprint(task))))
+	return etag(task.Version)
 }
 
 // TasksByCreatedAt is a type to sort a slice of TaskResource by creation date.
@@ -50,6 +200,12 @@ type CommentResource struct {
 	User      UserResource `json:"user"`
 	TaskID    int          `db:"task_id" json:"task_id"`
 	Content   string       `json:"content"`
+	Version   int          `json:"-"`
+}
+
+// Etag returns the strong Etag of the resource, derived from its version
+func (comment *CommentResource) Etag() string {
+	return etag(comment.Version)
 }
 
 // CommentsByCreatedAt is a type to sort a slice of CommentResource by creation
@@ -59,3 +215,34 @@ type CommentsByCreatedAt []CommentResource
 func (c CommentsByCreatedAt) Len() int           { return len(c) }
 func (c CommentsByCreatedAt) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
 func (c CommentsByCreatedAt) Less(i, j int) bool { return c[i].CreatedAt.After(c[j].CreatedAt) }
+
+// TransitionResource is a resource that represents a change of the status of
+// a task. It embeds a UserResource
+type TransitionResource struct {
+	Resource
+	CreatedAt time.Time    `db:"created_at" json:"created_at"`
+	User      UserResource `json:"user"`
+	From      *string      `db:"from_status" json:"from"`
+	To        string       `db:"to_status" json:"to"`
+}
+
+// LabelResource is a resource that represents a label
+type LabelResource struct {
+	Resource
+	CreatedAt   time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at" json:"updated_at"`
+	Name        string    `json:"name"`
+	Color       string    `json:"color"`
+	Description string    `json:"description"`
+}
+
+// ProjectResource is a resource that represents a project. It embeds the
+// UserResource of its owner
+type ProjectResource struct {
+	Resource
+	CreatedAt   time.Time    `db:"created_at" json:"created_at"`
+	UpdatedAt   time.Time    `db:"updated_at" json:"updated_at"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Owner       UserResource `json:"owner"`
+}
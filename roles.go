@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+func getRolesHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+	if _, ok := authorizeWorkspace(c, user, workspaceView); !ok {
+		return
+	}
+
+	var members []MemberResource
+	if err := selectWorkspaceRoles.Select(&members); err != nil {
+		log.Printf("couldn't select from workspace_roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, members)
+}
+
+// authorizeGrant checks that the authenticated user can change the workspace
+// role of the user_id parameter. Nobody can change their own role, so that
+// the workspace always keeps an owner. It answers and returns false otherwise
+func authorizeGrant(c *gin.Context) (string, int, bool) {
+	user, ok := authUser(c)
+	if !ok {
+		return "", 0, false
+	}
+	role, ok := authorizeWorkspace(c, user, roleManage)
+	if !ok {
+		return "", 0, false
+	}
+
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return "", 0, false
+	}
+	if userID == user.ID {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "user_id", Message: "users can't change their own role"})
+		return "", 0, false
+	}
+	current, err := projectRole(User{Model: Model{ID: userID}}, nil)
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return "", 0, false
+	}
+	if !canGrant(role, current) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return "", 0, false
+	}
+	return role, userID, true
+}
+
+// putRolesUserIDHandler grants a workspace role to a user, replacing their
+// previous one
+func putRolesUserIDHandler(c *gin.Context) {
+	role, userID, ok := authorizeGrant(c)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Role string `json:"role" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if err := checkRole(body.Role); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if !canGrant(role, body.Role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var previous *string
+	err = tx.Stmtx(upsertWorkspaceRole).Get(&previous, userID, body.Role)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't insert to workspace_roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var before interface{}
+	if previous != nil {
+		before = gin.H{"user_id": userID, "role": *previous}
+	}
+	after := gin.H{"user_id": userID, "role": body.Role}
+	if err := audit(c, tx, "update", "/roles/"+strconv.Itoa(userID), before, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// deleteRolesUserIDHandler revokes the workspace role of a user. They keep
+// their project roles, and the ownership of their tasks
+func deleteRolesUserIDHandler(c *gin.Context) {
+	_, userID, ok := authorizeGrant(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var role string
+	err = tx.Stmtx(deleteWorkspaceRole).Get(&role, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't delete from workspace_roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	before := gin.H{"user_id": userID, "role": role}
+	if err := audit(c, tx, "delete", "/roles/"+strconv.Itoa(userID), before, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
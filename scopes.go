@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// scopes are the scopes a token can be restricted to. A write scope includes
+// the read scope of the same resource. Each route declares the scope it needs
+// in handlers.go
+var scopes = []string{
+	"tasks:read", "tasks:write",
+	"comments:read", "comments:write",
+	"projects:read", "projects:write",
+	"labels:read", "labels:write",
+	"users:read", "users:write",
+	"roles:read", "roles:write",
+	"tokens:read", "tokens:write",
+	"clients:read", "clients:write",
+	"audit:read",
+	"webhooks:read", "webhooks:write",
+}
+
+// credentialScopes are the scopes that OAuth clients can't be granted: they
+// manage tokens, clients and passwords, with which a client could turn its
+// grant into a credential that outlives it
+var credentialScopes = map[string]bool{
+	"tokens:read": true, "tokens:write": true,
+	"clients:read": true, "clients:write": true,
+	"users:write": true,
+}
+
+// projectScopeRegexp matches the scopes that restrict a token to a project.
+// A token with such scopes can only act on the tasks of these projects, and
+// not on the workspace nor on personal tasks, which need the implicit
+// project:* scope of unrestricted tokens
+var projectScopeRegexp = regexp.MustCompile(`^project:[0-9]+$`)
+
+// tokenScopes are the scopes of a token. nil grants every scope
+type tokenScopes []string
+
+// has tells whether the scopes include scope
+func (s tokenScopes) has(scope string) bool {
+	if s == nil {
+		return true
+	}
+	if scope == "project:*" {
+		return len(s.projects()) == 0
+	}
+	for _, granted := range s {
+		if granted == scope || strings.HasSuffix(scope, ":read") && granted == strings.TrimSuffix(scope, ":read")+":write" {
+			return true
+		}
+	}
+	if projectScopeRegexp.MatchString(scope) {
+		return len(s.projects()) == 0
+	}
+	return false
+}
+
+// projects returns the projects that the scopes restrict the token to. It is
+// empty if the token isn't restricted to projects
+func (s tokenScopes) projects() []int {
+	var ids []int
+	for _, scope := range s {
+		if projectScopeRegexp.MatchString(scope) {
+			id, _ := strconv.Atoi(strings.TrimPrefix(scope, "project:"))
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// grantable returns the scopes that can be granted to an OAuth client out of
+// s, which is every scope if nil. A write scope that can't be granted is
+// replaced with its read scope if that one can. The result is never nil
+func (s tokenScopes) grantable() tokenScopes {
+	if s == nil {
+		s = tokenScopes(scopes)
+	}
+	granted := tokenScopes{}
+	for _, scope := range s {
+		if credentialScopes[scope] {
+			scope = strings.TrimSuffix(scope, ":write") + ":read"
+		}
+		if !credentialScopes[scope] && !granted.has(scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return granted
+}
+
+// missing returns a scope of requested that the scopes lack, so that a token
+// can't mint another one with more scopes than its own. It is empty if there
+// is none
+func (s tokenScopes) missing(requested tokenScopes) string {
+	if requested == nil {
+		requested = tokenScopes(scopes)
+	}
+	if len(s.projects()) > 0 && len(requested.projects()) == 0 {
+		return projectScope(nil)
+	}
+	for _, scope := range requested {
+		if !s.has(scope) {
+			return scope
+		}
+	}
+	return ""
+}
+
+// checkScopes returns a *FieldError unless requested are valid scopes
+func checkScopes(requested []string) error {
+	if len(requested) == 0 {
+		return &FieldError{Field: "scopes", Message: "must be null or hold at least one scope"}
+	}
+	for _, scope := range requested {
+		if scopeRank(scope) < 0 && !projectScopeRegexp.MatchString(scope) {
+			return &FieldError{Field: "scopes", Message: fmt.Sprintf("%q isn't one of %v nor project:<id>", scope, scopes)}
+		}
+	}
+	return nil
+}
+
+// scopeRank returns the position of a scope in scopes, or -1
+func scopeRank(scope string) int {
+	for i, s := range scopes {
+		if s == scope {
+			return i
+		}
+	}
+	return -1
+}
+
+// projectScope returns the scope needed to act on a project, or on the
+// workspace and on personal tasks if projectID is nil
+func projectScope(projectID *int) string {
+	if projectID == nil {
+		return "project:*"
+	}
+	return "project:" + strconv.Itoa(*projectID)
+}
+
+// ScopeError is the error of a token that lacks a scope
+type ScopeError struct {
+	Scope   string `json:"scope"`
+	Message string `json:"message"`
+}
+
+func (e *ScopeError) Error() string {
+	return e.Message
+}
+
+// checkScope returns a *ScopeError unless the token of user has scope. OAuth
+// access tokens never have the credential scopes, even those issued without
+// scopes
+func checkScope(user User, scope string) error {
+	if user.bearer && credentialScopes[scope] {
+		return &ScopeError{Scope: scope, Message: fmt.Sprintf("OAuth access tokens can't have the %s scope", scope)}
+	}
+	if !user.scopes.has(scope) {
+		return &ScopeError{Scope: scope, Message: fmt.Sprintf("the token lacks the %s scope", scope)}
+	}
+	return nil
+}
+
+// denyScope answers 403 Forbidden with the scope that the token lacks
+func denyScope(c *gin.Context, err *ScopeError) {
+	c.Header("WWW-Authenticate", fmt.Sprintf(`Token error="insufficient_scope", scope=%q`, err.Scope))
+	c.JSON(http.StatusForbidden, err)
+	c.Abort()
+}
+
+// authorizeScope answers 403 Forbidden and returns false unless the token of
+// user has scope
+func authorizeScope(c *gin.Context, user User, scope string) bool {
+	if err := checkScope(user, scope); err != nil {
+		denyScope(c, err.(*ScopeError))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// sessionCookieName is the name of the cookie that holds the ID of a session
+const sessionCookieName = "session"
+
+// sessionTTL is how long a session lasts without being used. It is set by the
+// SESSION_TTL env
+var sessionTTL = 7 * 24 * time.Hour
+
+// secureCookies tells whether cookies are only sent over https. It is set by
+// the SESSION_COOKIE_SECURE env, e.g. to run on http locally
+var secureCookies = true
+
+// dummyPasswordHash is compared to the passwords of unknown users, so that
+// they take as long to reject as the wrong passwords of known users
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+
+// checkPassword returns a *FieldError unless password is long enough. bcrypt
+// ignores what is after 72 bytes
+func checkPassword(password string) error {
+	if len(password) < 8 || len(password) > 72 {
+		return &FieldError{Field: "password", Message: "must be 8 to 72 bytes long"}
+	}
+	return nil
+}
+
+// session is the session of a user
+type session struct {
+	User
+	SessionID int       `db:"session_id"`
+	CSRFToken string    `db:"csrf_token"`
+	ExpiresAt time.Time `db:"expires_at"`
+}
+
+// selectSession selects the session of the session cookie. It returns
+// sql.ErrNoRows if there is none, or if it expired
+func selectSession(c *gin.Context) (session, error) {
+	cookie, err := c.Request.Cookie(sessionCookieName)
+	if err != nil {
+		return session{}, sql.ErrNoRows
+	}
+	var s session
+	if err := selectUserWhereSessionHash.Get(&s, hashToken(cookie.Value)); err != nil {
+		return session{}, err
+	}
+	if _, err := touchSession.Exec(s.SessionID, int(sessionTTL.Seconds())); err != nil {
+		log.Printf("couldn't update sessions: %v", err)
+	}
+	return s, nil
+}
+
+// checkCSRF tells whether token is the CSRF token of the session
+func (s session) checkCSRF(token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRFToken)) == 1
+}
+
+// safeMethod tells whether a request method doesn't change anything, so that
+// it doesn't need a CSRF token
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// authenticateSession returns the user of the session cookie. Unless the
+// request is safe, it must send the CSRF token of the session in the
+// X-CSRF-Token header, because browsers send cookies with the requests of
+// other sites. It answers and returns false otherwise
+func authenticateSession(c *gin.Context) (session, bool) {
+	s, err := selectSession(c)
+	if err == sql.ErrNoRows {
+		challenge(c)
+		return session{}, false
+	}
+	if err != nil {
+		log.Printf("couldn't select from sessions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return session{}, false
+	}
+	if !safeMethod(c.Request.Method) && !s.checkCSRF(c.Request.Header.Get("X-CSRF-Token")) {
+		c.JSON(http.StatusForbidden, &FieldError{Field: "X-CSRF-Token", Message: "must be the CSRF token of the session"})
+		c.Abort()
+		return session{}, false
+	}
+	return s, true
+}
+
+// setSessionCookie sets the session cookie. A negative maxAge deletes it
+func setSessionCookie(c *gin.Context, value string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   secureCookies,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// answerSession answers the session of a user
+func answerSession(c *gin.Context, statusCode int, userID int, csrfToken string, expiresAt time.Time) {
+	resource := SessionResource{CSRFToken: csrfToken, ExpiresAt: expiresAt}
+	if err := selectProfileWhereID.Get(&resource.User, userID); err != nil {
+		log.Printf("couldn't select from users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(statusCode, resource)
+}
+
+// postLoginHandler logs a user in with their username and password, and starts
+// a session. Browsers then authenticate with the session cookie instead of a
+// token. Only JSON is accepted, which other sites can't post without a CORS
+// preflight, so that they can't log browsers into an account of their choice
+func postLoginHandler(c *gin.Context) {
+	if c.ContentType() != "application/json" {
+		c.AbortWithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
+	var body struct {
+		Username string `json:"username" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	attempt := newAuthAttempt(c, "username", strings.ToLower(body.Username), false)
+	locked, failed := attempt.locked(c)
+	if locked {
+		return
+	}
+	var account struct {
+		User
+		PasswordHash *string `db:"password_hash"`
+	}
+	err := selectUserWhereUsername.Get(&account, body.Username)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("couldn't select from users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	hash := dummyPasswordHash
+	if account.PasswordHash != nil {
+		hash = []byte(*account.PasswordHash)
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(body.Password)) != nil || account.PasswordHash == nil {
+		attempt.fail("wrong username or password")
+		c.JSON(http.StatusUnauthorized, &FieldError{Field: "password", Message: "wrong username or password"})
+		return
+	}
+	if failed {
+		attempt.succeed()
+	}
+
+	// A new session is started at each login, so that a session ID set by
+	// someone else before can't be used
+	if cookie, err := c.Request.Cookie(sessionCookieName); err == nil {
+		if _, err := deleteSession.Exec(hashToken(cookie.Value)); err != nil {
+			log.Printf("couldn't delete from sessions: %v", err)
+		}
+	}
+	sessionID, err := newToken()
+	if err != nil {
+		log.Printf("couldn't generate a session ID: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	csrfToken, err := newToken()
+	if err != nil {
+		log.Printf("couldn't generate a CSRF token: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	expiresAt := time.Now().Add(sessionTTL)
+	if _, err := insertSession.Exec(hashToken(sessionID), account.ID, csrfToken, expiresAt); err != nil {
+		log.Printf("couldn't insert to sessions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(c, sessionID, int(sessionTTL.Seconds()))
+	answerSession(c, http.StatusOK, account.ID, csrfToken, expiresAt)
+}
+
+// postLogoutHandler ends the session of the session cookie
+func postLogoutHandler(c *gin.Context) {
+	if _, ok := authenticateSession(c); !ok {
+		return
+	}
+
+	cookie, _ := c.Request.Cookie(sessionCookieName)
+	if _, err := deleteSession.Exec(hashToken(cookie.Value)); err != nil {
+		log.Printf("couldn't delete from sessions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	setSessionCookie(c, "", -1)
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// getSessionHandler answers the session of the session cookie, e.g. for a page
+// to get its CSRF token
+func getSessionHandler(c *gin.Context) {
+	s, ok := authenticateSession(c)
+	if !ok {
+		return
+	}
+
+	answerSession(c, http.StatusOK, s.ID, s.CSRFToken, s.ExpiresAt)
+}
+
+// putUsersIDPasswordHandler sets the password of a user. Users who already
+// have a password must send it as current_password to change it, whereas
+// admins can reset the passwords of the users they manage. The other sessions
+// of the user are ended
+func putUsersIDPasswordHandler(c *gin.Context) {
+	var profile ProfileResource
+	user, ok := selectManagedProfile(c, &profile, true)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Password        string `json:"password" binding:"required"`
+		CurrentPassword string `json:"current_password"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if err := checkPassword(body.Password); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if profile.ID == user.ID {
+		var current *string
+		if err := selectUserPasswordHash.Get(&current, user.ID); err != nil {
+			log.Printf("couldn't select from users: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if current != nil && bcrypt.CompareHashAndPassword([]byte(*current), []byte(body.CurrentPassword)) != nil {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: "current_password", Message: "is wrong"})
+			return
+		}
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(body.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("couldn't hash a password: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmtx(updateUserPassword).Exec(string(hash), profile.ID); err != nil {
+		log.Printf("couldn't update users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	current := ""
+	if cookie, err := c.Request.Cookie(sessionCookieName); err == nil && profile.ID == user.ID {
+		current = hashToken(cookie.Value)
+	}
+	if _, err := tx.Stmtx(deleteOtherSessions).Exec(profile.ID, current); err != nil {
+		log.Printf("couldn't delete from sessions: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	// The audit log doesn't hold password hashes
+	if err := audit(c, tx, "update", "/users/"+strconv.Itoa(profile.ID)+"/password", nil, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// purgeSessionsEvery deletes the expired sessions periodically. It never
+// returns
+func purgeSessionsEvery(interval time.Duration) {
+	for {
+		if _, err := deleteExpiredSessions.Exec(); err != nil {
+			log.Printf("couldn't purge sessions: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -1,131 +1,341 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 )
 
-func create() {
-	db.MustExec(`CREATE OR REPLACE FUNCTION update_updated_at_column()
-RETURNS TRIGGER AS $$
-BEGIN
-	NEW.updated_at = CURRENT_TIMESTAMP;
-	RETURN NEW;
-END;
-$$ language 'plpgsql';
-
-CREATE TABLE users (
-	"id" SERIAL PRIMARY KEY,
-	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-	"username" TEXT,
-	"token" TEXT
-);
-
-CREATE TRIGGER update_users_updated_at BEFORE UPDATE
-ON users FOR EACH ROW EXECUTE PROCEDURE
-update_updated_at_column();
-
-CREATE TABLE tasks (
-	"id" SERIAL PRIMARY KEY,
-	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-	"name" TEXT NOT NULL,
-	"user_id" SERIAL REFERENCES users(id),
-	"description" TEXT,
-	"progression" integer DEFAULT 0
-);
-
-CREATE TRIGGER update_tasks_updated_at BEFORE UPDATE
-ON tasks FOR EACH ROW EXECUTE PROCEDURE
-update_updated_at_column();
-
-CREATE TABLE comments (
-	"id" SERIAL PRIMARY KEY,
-	"created_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-	"updated_at" TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-	"user_id" SERIAL REFERENCES users(id),
-	"task_id" SERIAL REFERENCES tasks(id),
-	"content" TEXT
-);
-
-CREATE TRIGGER update_comments_updated_at BEFORE UPDATE
-ON comments FOR EACH ROW EXECUTE PROCEDURE
-update_updated_at_column();`)
+// fromTasks is the FROM clause of the queries on tasks
+const fromTasks = `FROM tasks JOIN users ON tasks.user_id = users.id`
+
+// blockedTasks is the condition of the tasks that have a blocker that isn't
+// in a final status. The final statuses are a placeholder
+const blockedTasks = `EXISTS (SELECT 1 FROM task_dependencies JOIN tasks AS blockers ON task_dependencies.blocker_id = blockers.id
+		WHERE task_dependencies.task_id = tasks.id AND blockers.deleted_at IS NULL AND blockers.status <> ALL(%s))`
+
+// selectTaskResources selects the columns of a TaskResource. It is shared by
+// the prepared statements and by taskQuery, and built by prepare because it
+// depends on the workflow
+var selectTaskResources string
+
+// taskResourcesQuery returns selectTaskResources, for the final statuses of
+// the workflow. They are written as literals, because the prepared statements
+// that share the query have their own parameters
+func taskResourcesQuery() string {
+	var finals []string
+	for _, status := range workflow.Final {
+		finals = append(finals, "'"+strings.Replace(status, "'", "''", -1)+"'")
+	}
+	blocked := fmt.Sprintf(blockedTasks, "ARRAY["+strings.Join(finals, ", ")+"]::text[]")
+	return `SELECT tasks.id, tasks.created_at, tasks.updated_at, tasks.deleted_at, tasks.name, tasks.description, tasks.progression, tasks.status, tasks.due_at, tasks.start_at, tasks.parent_id, tasks.weight, tasks.project_id, tasks.version, users.id AS "user.id", users.username AS "user.username",
+		(SELECT count(*) FROM tasks AS subtasks WHERE subtasks.parent_id = tasks.id AND subtasks.deleted_at IS NULL) AS subtasks,
+		ARRAY(SELECT labels.name FROM task_labels JOIN labels ON task_labels.label_id = labels.id WHERE task_labels.task_id = tasks.id ORDER BY labels.name) AS labels,
+		` + blocked + ` AS blocked
+		` + fromTasks
 }
 
+// selectProjectResources selects the columns of a ProjectResource
+const selectProjectResources = `SELECT projects.id, projects.created_at, projects.updated_at, projects.name, projects.description, users.id AS "owner.id", users.username AS "owner.username"
+		FROM projects JOIN users ON projects.owner_id = users.id`
+
+// selectAuditEntries selects the columns of an AuditEntryResource
+const selectAuditEntries = `SELECT audit_log.id, audit_log.created_at, audit_log.actor_id, audit_log.request_id, audit_log.action, audit_log.resource, audit_log.before, audit_log.after, audit_log.patch
+		FROM audit_log`
+
 var (
 	insertUser,
 	insertTask,
 	insertComment,
-	selectTasks,
 	selectTaskWhereID,
-	selectTasksWhereUserID,
+	selectDeletedTaskWhereID,
 	selectCommentsWhereTaskID,
 	selectCommentsWhereUserID,
-	selectUsersWhereToken,
+	selectCommentValidatorsWhereTaskID,
+	selectCommentValidatorsWhereUserID,
+	selectUserWhereTokenHash,
+	touchAPIToken,
+	insertAPIToken,
+	selectAPITokensWhereUserID,
+	selectAPITokenWhereID,
+	revokeAPIToken,
+	expireAPIToken,
+	insertAccessToken,
+	insertOAuthClient,
+	selectOAuthClientsWhereUserID,
+	selectOAuthClientWhereClientID,
+	revokeOAuthClient,
+	insertOAuthCode,
+	useOAuthCode,
+	insertOAuthRefreshToken,
+	useOAuthRefreshToken,
+	selectUserWhereUsername,
+	selectUserPasswordHash,
+	updateUserPassword,
+	insertSession,
+	selectUserWhereSessionHash,
+	touchSession,
+	deleteSession,
+	deleteOtherSessions,
+	deleteExpiredSessions,
+	selectAuthLock,
+	insertAuthFailure,
+	lockAuthKey,
+	deleteAuthFailures,
+	deleteStaleAuthFailures,
+	insertAuditEntry,
+	selectTaskRevisions,
+	selectTaskRevisionWhereID,
+	selectTaskRevisionAsOf,
+	insertTaskEvent,
+	notifyTaskEvent,
+	selectTaskEvents,
+	selectTaskEventWhereID,
+	deleteOldTaskEvents,
+	upsertTaskViewer,
+	touchTaskViewers,
+	deleteTaskViewers,
+	deleteStaleTaskViewers,
+	selectTaskViewers,
+	insertWebhook,
+	selectWebhooksWhereUserID,
+	selectWebhookWhereID,
+	deleteWebhook,
+	selectEventWebhooks,
+	insertWebhookDelivery,
+	selectWebhookDeliveries,
+	selectWebhookAttempts,
+	redeliverWebhookDelivery,
+	claimWebhookDeliveries,
+	insertWebhookAttempt,
+	deliverWebhookDelivery,
+	retryWebhookDelivery,
+	failWebhookDelivery,
+	selectProfileWhereID,
+	updateUserProfile,
+	deactivateUser,
+	reactivateUser,
 	updateTasksName,
 	updateTasksDescription,
-	updateTasksProgression *sqlx.Stmt
+	updateTasksProgression,
+	updateTasksStatus,
+	updateTasksDueAt,
+	updateTasksStartAt,
+	updateTasksParentID,
+	updateTasksWeight,
+	selectTaskIsAncestor,
+	lockTaskWhereID,
+	rollupTaskProgression,
+	insertTaskDependency,
+	deleteTaskDependency,
+	selectTaskDependsOn,
+	selectUpstreamDependencies,
+	bumpTaskVersionsWhereBlockerID,
+	insertProject,
+	selectProjects,
+	selectProjectWhereID,
+	updateProject,
+	insertProjectMember,
+	deleteProjectMember,
+	selectProjectMembers,
+	updateProjectMemberRole,
+	selectProjectMemberRole,
+	selectRoles,
+	selectWorkspaceRoles,
+	upsertWorkspaceRole,
+	deleteWorkspaceRole,
+	updateTasksProjectID,
+	selectTaskDescendants,
+	insertTaskTransition,
+	selectTransitionsWhereTaskID,
+	selectPendingReminders,
+	claimReminder,
+	markReminderSent,
+	releaseReminder,
+	insertLabel,
+	selectLabels,
+	selectLabelWhereID,
+	selectLabelNamesWhereName,
+	updateLabel,
+	deleteLabel,
+	bumpTaskVersionsWhereLabelID,
+	selectTasksWhereLabelID,
+	deleteTaskLabels,
+	insertTaskLabels,
+	bumpTaskVersion,
+	deleteTask,
+	deleteCommentsWhereTaskID,
+	restoreTask,
+	restoreCommentsWhereTaskID *sqlx.Stmt
 )
 
 func prepare() {
+	selectTaskResources = taskResourcesQuery()
+
 	var err error
-	insertUser, err = db.Preparex(`INSERT INTO users ("username", "token") VALUES ($1, $2);`)
+	insertUser, err = db.Preparex(`INSERT INTO users ("username", "name") VALUES ($1, $2) RETURNING id;`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	insertTask, err = db.Preparex(`INSERT INTO tasks ("name", "user_id", "description", "progression") VALUES ($1, $2, $3, $4);`)
+	insertTask, err = db.Preparex(`INSERT INTO tasks ("name", "user_id", "description", "progression", "status", "due_at", "start_at", "parent_id", "weight", "project_id") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id;`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	insertComment, err = db.Preparex(`INSERT INTO comments ("user_id", "task_id", "content") VALUES ($1, $2, $3)`)
+	insertComment, err = db.Preparex(`INSERT INTO comments ("user_id", "task_id", "content") VALUES ($1, $2, $3) RETURNING id;`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	selectTasks, err = db.Preparex(`SELECT tasks.id, tasks.created_at, tasks.updated_at, tasks.name, tasks.description, tasks.progression, users.id AS "user.id", users.username AS "user.username"
-		FROM tasks JOIN users ON tasks.user_id = users.id
-		ORDER BY created_at DESC;`)
+	selectTaskWhereID, err = db.Preparex(selectTaskResources + `
+		WHERE tasks.id = $1 AND tasks.deleted_at IS NULL;`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	selectTaskWhereID, err = db.Preparex(`SELECT tasks.id, tasks.created_at, tasks.updated_at, tasks.name, tasks.description, tasks.progression, users.id AS "user.id", users.username AS "user.username"
-		FROM tasks JOIN users ON tasks.user_id = users.id
-		WHERE tasks.id = $1;`)
+	selectDeletedTaskWhereID, err = db.Preparex(selectTaskResources + `
+		WHERE tasks.id = $1 AND tasks.deleted_at IS NOT NULL;`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	selectTasksWhereUserID, err = db.Preparex(`SELECT tasks.id, tasks.created_at, tasks.updated_at, tasks.name, tasks.description, tasks.progression, users.id AS "user.id", users.username AS "user.username"
-		FROM tasks JOIN users ON tasks.user_id = users.id
-		WHERE user_id = $1
+	selectCommentsWhereTaskID, err = db.Preparex(`SELECT comments.id, comments.created_at, comments.content, comments.task_id, comments.version, users.id AS "user.id", users.username AS "user.username"
+		FROM comments JOIN users ON comments.user_id = users.id
+		WHERE task_id = $1 AND comments.deleted_at IS NULL
 		ORDER BY created_at DESC;`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	selectCommentsWhereTaskID, err = db.Preparex(`SELECT comments.id, comments.created_at, comments.content, comments.task_id, users.id AS "user.id", users.username AS "user.username"
+	selectCommentsWhereUserID, err = db.Preparex(`SELECT comments.id, comments.created_at, comments.content, comments.task_id, comments.version, users.id AS "user.id", users.username AS "user.username"
 		FROM comments JOIN users ON comments.user_id = users.id
-		WHERE task_id = $1
+		WHERE user_id = $1 AND comments.deleted_at IS NULL
 		ORDER BY created_at DESC;`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	selectCommentsWhereUserID, err = db.Preparex(`SELECT comments.id, comments.created_at, comments.content, comments.task_id, users.id AS "user.id", users.username AS "user.username"
+	// Deleted comments count in last_modified, so that deleting one changes it
+	selectCommentValidatorsWhereTaskID, err = db.Preparex(`SELECT count(*) FILTER (WHERE comments.deleted_at IS NULL) AS count, max(GREATEST(comments.updated_at, users.updated_at)) AS last_modified
+		FROM comments JOIN users ON comments.user_id = users.id
+		WHERE task_id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectCommentValidatorsWhereUserID, err = db.Preparex(`SELECT count(*) FILTER (WHERE comments.deleted_at IS NULL) AS count, max(GREATEST(comments.updated_at, users.updated_at)) AS last_modified
 		FROM comments JOIN users ON comments.user_id = users.id
+		WHERE user_id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the user of a token from its hash, unless the token is revoked
+	// or expired, or the user is deactivated. $2 tells whether the token is an
+	// OAuth access token, whose client mustn't be revoked either
+	selectUserWhereTokenHash, err = db.Preparex(`SELECT users.id, users.created_at, users.updated_at, users.username, users.name, users.deactivated_at, api_tokens.id AS token_id, api_tokens.scopes
+		FROM api_tokens JOIN users ON api_tokens.user_id = users.id
+			LEFT JOIN oauth_clients ON api_tokens.client_id = oauth_clients.id
+		WHERE api_tokens.hash = $1 AND api_tokens.revoked_at IS NULL AND (api_tokens.expires_at IS NULL OR api_tokens.expires_at > now())
+			AND (api_tokens.client_id IS NOT NULL) = $2 AND oauth_clients.revoked_at IS NULL
+			AND users.deactivated_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Records the use of a token, at most once a minute so that every request
+	// doesn't write
+	touchAPIToken, err = db.Preparex(`UPDATE api_tokens SET last_used_at = now()
+		WHERE id = $1 AND (last_used_at IS NULL OR last_used_at < now() - interval '1 minute');`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertAPIToken, err = db.Preparex(`INSERT INTO api_tokens ("user_id", "name", "hash", "expires_at", "scopes") VALUES ($1, $2, $3, $4, $5) RETURNING id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectAPITokensWhereUserID, err = db.Preparex(`SELECT id, name, scopes, created_at, last_used_at, expires_at, revoked_at FROM api_tokens
+		WHERE user_id = $1 AND client_id IS NULL
+		ORDER BY id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectAPITokenWhereID, err = db.Preparex(`SELECT id, name, scopes, created_at, last_used_at, expires_at, revoked_at FROM api_tokens
+		WHERE id = $1 AND user_id = $2 AND client_id IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	revokeAPIToken, err = db.Preparex(`UPDATE api_tokens SET revoked_at = now() WHERE id = $1 AND revoked_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Makes the token $1 expire at $2, unless it expires before
+	expireAPIToken, err = db.Preparex(`UPDATE api_tokens SET expires_at = $2 WHERE id = $1 AND (expires_at IS NULL OR expires_at > $2);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertAccessToken, err = db.Preparex(`INSERT INTO api_tokens ("user_id", "name", "hash", "expires_at", "scopes", "client_id") VALUES ($1, $2, $3, $4, $5, $6);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertOAuthClient, err = db.Preparex(`INSERT INTO oauth_clients ("client_id", "secret_hash", "user_id", "name", "redirect_uris", "scopes") VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, client_id, name, redirect_uris, secret_hash IS NULL AS public, scopes, created_at, revoked_at;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectOAuthClientsWhereUserID, err = db.Preparex(`SELECT id, client_id, name, redirect_uris, secret_hash IS NULL AS public, scopes, created_at, revoked_at FROM oauth_clients
 		WHERE user_id = $1
-		ORDER BY created_at DESC;`)
+		ORDER BY id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectOAuthClientWhereClientID, err = db.Preparex(`SELECT id, client_id, name, redirect_uris, secret_hash IS NULL AS public, scopes, created_at, revoked_at, user_id, secret_hash FROM oauth_clients
+		WHERE client_id = $1 AND revoked_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	revokeOAuthClient, err = db.Preparex(`UPDATE oauth_clients SET revoked_at = COALESCE(revoked_at, now()) WHERE id = $1 AND user_id = $2
+		RETURNING id, client_id, name, redirect_uris, secret_hash IS NULL AS public, scopes, created_at, revoked_at;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertOAuthCode, err = db.Preparex(`INSERT INTO oauth_codes ("hash", "client_id", "user_id", "redirect_uri", "scopes", "code_challenge", "expires_at") VALUES ($1, $2, $3, $4, $5, $6, $7);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Uses an authorization code, which works once
+	useOAuthCode, err = db.Preparex(`UPDATE oauth_codes SET used_at = now()
+		WHERE hash = $1 AND used_at IS NULL AND expires_at > now()
+		RETURNING client_id, user_id, redirect_uri, scopes, code_challenge;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertOAuthRefreshToken, err = db.Preparex(`INSERT INTO oauth_refresh_tokens ("client_id", "user_id", "hash", "scopes", "expires_at") VALUES ($1, $2, $3, $4, $5);`)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	selectUsersWhereToken, err = db.Preparex(`SELECT * FROM users WHERE token = $1`)
+	// Uses a refresh token, which works once: it is replaced by a new one
+	useOAuthRefreshToken, err = db.Preparex(`UPDATE oauth_refresh_tokens SET revoked_at = now()
+		WHERE hash = $1 AND revoked_at IS NULL AND expires_at > now()
+		RETURNING client_id, user_id, scopes;`)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -144,21 +354,689 @@ func prepare() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	updateTasksStatus, err = db.Preparex(`UPDATE tasks SET status = $1 WHERE id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateTasksDueAt, err = db.Preparex(`UPDATE tasks SET due_at = $1 WHERE id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateTasksStartAt, err = db.Preparex(`UPDATE tasks SET start_at = $1 WHERE id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateTasksParentID, err = db.Preparex(`UPDATE tasks SET parent_id = $1 WHERE id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateTasksWeight, err = db.Preparex(`UPDATE tasks SET weight = $1 WHERE id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tells whether the task $2 is the task $1 or one of its ancestors
+	selectTaskIsAncestor, err = db.Preparex(`WITH RECURSIVE ancestors (id, parent_id) AS (
+			SELECT id, parent_id FROM tasks WHERE id = $1
+			UNION
+			SELECT tasks.id, tasks.parent_id FROM tasks JOIN ancestors ON tasks.id = ancestors.parent_id
+		)
+		SELECT EXISTS (SELECT 1 FROM ancestors WHERE id = $2);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Locks a task until the end of the transaction, e.g. so that the
+	// statements that follow see the writes committed meanwhile
+	lockTaskWhereID, err = db.Preparex(`SELECT id FROM tasks WHERE id = $1 FOR UPDATE;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Sets the progression of a task to the mean progression of its subtasks,
+	// weighted by their weight. It returns the parent of the task, if the
+	// progression changed and must be rolled up further
+	rollupTaskProgression, err = db.Preparex(`UPDATE tasks SET progression = rollup.progression, version = version + 1
+		FROM (SELECT round(sum(progression * weight)::numeric / sum(weight))::integer AS progression FROM tasks WHERE parent_id = $1 AND deleted_at IS NULL) AS rollup
+		WHERE tasks.id = $1 AND rollup.progression IS NOT NULL AND tasks.progression <> rollup.progression
+		RETURNING tasks.parent_id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertTaskDependency, err = db.Preparex(`INSERT INTO task_dependencies ("task_id", "blocker_id") VALUES ($1, $2) ON CONFLICT DO NOTHING;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteTaskDependency, err = db.Preparex(`DELETE FROM task_dependencies WHERE task_id = $1 AND blocker_id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Tells whether the task $1 depends on the task $2, directly or not
+	selectTaskDependsOn, err = db.Preparex(`WITH RECURSIVE upstream (id) AS (
+			SELECT $1::integer
+			UNION
+			SELECT task_dependencies.blocker_id FROM task_dependencies JOIN upstream ON task_dependencies.task_id = upstream.id
+		)
+		SELECT EXISTS (SELECT 1 FROM upstream WHERE id = $2);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the dependencies upstream of the task $1, following the blockers
+	// that aren't in the trash nor in one of the final statuses $2
+	selectUpstreamDependencies, err = db.Preparex(`WITH RECURSIVE upstream (task_id, blocker_id) AS (
+			SELECT task_dependencies.task_id, task_dependencies.blocker_id FROM task_dependencies
+			WHERE task_dependencies.task_id = $1
+			UNION
+			SELECT task_dependencies.task_id, task_dependencies.blocker_id FROM task_dependencies JOIN upstream ON task_dependencies.task_id = upstream.blocker_id
+		)
+		SELECT upstream.task_id, upstream.blocker_id FROM upstream JOIN tasks ON upstream.blocker_id = tasks.id
+		WHERE tasks.deleted_at IS NULL AND tasks.status <> ALL($2);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The tasks blocked by a task are flagged according to its status, so
+	// their Etag must change along with it
+	bumpTaskVersionsWhereBlockerID, err = db.Preparex(`UPDATE tasks SET version = version + 1 WHERE id IN (SELECT task_id FROM task_dependencies WHERE blocker_id = $1);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertProject, err = db.Preparex(`INSERT INTO projects ("name", "description", "owner_id") VALUES ($1, $2, $3) RETURNING id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects every project if $1, or else the projects of the user $2
+	selectProjects, err = db.Preparex(selectProjectResources + `
+		WHERE $1 OR projects.id IN (SELECT project_id FROM project_members WHERE user_id = $2)
+		ORDER BY projects.id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectProjectWhereID, err = db.Preparex(selectProjectResources + `
+		WHERE projects.id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateProject, err = db.Preparex(`UPDATE projects SET name = $1, description = $2 WHERE id = $3;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertProjectMember, err = db.Preparex(`INSERT INTO project_members ("project_id", "user_id", "role") VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteProjectMember, err = db.Preparex(`DELETE FROM project_members WHERE project_id = $1 AND user_id = $2 RETURNING role;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectProjectMembers, err = db.Preparex(`SELECT users.id, users.username, project_members.role FROM project_members JOIN users ON project_members.user_id = users.id
+		WHERE project_members.project_id = $1
+		ORDER BY users.id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects an active user from their username, with their password hash
+	selectUserWhereUsername, err = db.Preparex(`SELECT id, created_at, updated_at, username, name, deactivated_at, password_hash FROM users
+		WHERE lower(username) = lower($1) AND deactivated_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectUserPasswordHash, err = db.Preparex(`SELECT password_hash FROM users WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateUserPassword, err = db.Preparex(`UPDATE users SET password_hash = $1 WHERE id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertSession, err = db.Preparex(`INSERT INTO sessions ("hash", "user_id", "csrf_token", "expires_at") VALUES ($1, $2, $3, $4) RETURNING id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the user of a session from its hash, unless the session expired
+	// or the user is deactivated
+	selectUserWhereSessionHash, err = db.Preparex(`SELECT users.id, users.created_at, users.updated_at, users.username, users.name, users.deactivated_at,
+			sessions.id AS session_id, sessions.csrf_token, sessions.expires_at
+		FROM sessions JOIN users ON sessions.user_id = users.id
+		WHERE sessions.hash = $1 AND sessions.expires_at > now() AND users.deactivated_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Pushes back the expiry of the session $1 to $2 seconds from now, at most
+	// once a minute so that every request doesn't write
+	touchSession, err = db.Preparex(`UPDATE sessions SET expires_at = now() + $2 * interval '1 second'
+		WHERE id = $1 AND expires_at < now() + ($2 - 60) * interval '1 second';`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteSession, err = db.Preparex(`DELETE FROM sessions WHERE hash = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Deletes the sessions of the user $1, except the one whose hash is $2
+	deleteOtherSessions, err = db.Preparex(`DELETE FROM sessions WHERE user_id = $1 AND hash <> $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteExpiredSessions, err = db.Preparex(`DELETE FROM sessions WHERE expires_at < now();`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the latest lock of the keys $1, or NULL if none is locked, and
+	// whether the key $2 has failures
+	selectAuthLock, err = db.Preparex(`SELECT max(locked_until) FILTER (WHERE locked_until > now()) AS locked_until, coalesce(bool_or(key = $2), false) AS failed
+		FROM auth_failures WHERE key = ANY($1);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Counts a failure of the key $1. The count starts over when the key
+	// hasn't failed nor been locked for $2 seconds
+	insertAuthFailure, err = db.Preparex(`INSERT INTO auth_failures ("key", "failures", "failed_at") VALUES ($1, 1, now())
+		ON CONFLICT ("key") DO UPDATE SET failures = CASE
+			WHEN GREATEST(auth_failures.failed_at, auth_failures.locked_until) < now() - $2 * interval '1 second' THEN 1
+			ELSE auth_failures.failures + 1 END,
+		failed_at = now()
+		RETURNING failures;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Locks the key $1 for $2 seconds, unless it is locked for longer
+	lockAuthKey, err = db.Preparex(`UPDATE auth_failures SET locked_until = GREATEST(locked_until, now() + $2 * interval '1 second')
+		WHERE key = $1 RETURNING locked_until;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteAuthFailures, err = db.Preparex(`DELETE FROM auth_failures WHERE key = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertAuditEntry, err = db.Preparex(`INSERT INTO audit_log ("actor_id", "request_id", "action", "resource", "before", "after", "patch") VALUES ($1, $2, $3, $4, $5, $6, $7);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The revisions of a task are the entries of the audit log about it,
+	// newest first, before the entry $3 of the date $2. They are sorted by
+	// date, because the revisions backfilled for the tasks older than the
+	// audit log were inserted after newer ones
+	selectTaskRevisions, err = db.Preparex(`SELECT id, created_at, actor_id, request_id, action, before, after, patch FROM audit_log
+		WHERE resource = $1 AND (created_at, id) < ($2::timestamptz, $3)
+		ORDER BY created_at DESC, id DESC
+		LIMIT $4;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectTaskRevisionWhereID, err = db.Preparex(`SELECT after FROM audit_log WHERE id = $1 AND resource = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the task as it was recorded by its latest revision at $2
+	selectTaskRevisionAsOf, err = db.Preparex(`SELECT after FROM audit_log
+		WHERE resource = $1 AND created_at <= $2
+		ORDER BY created_at DESC, id DESC
+		LIMIT 1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Records an event of the task $3
+	insertTaskEvent, err = db.Preparex(`INSERT INTO task_events ("type", "resource", "task_id", "user_id", "project_id", "actor_id", "data")
+		SELECT $1::text, $2::text, id, user_id, project_id, $4::integer, $5::jsonb FROM tasks WHERE id = $3
+		RETURNING id, created_at, type, resource, task_id, user_id, project_id, actor_id, data;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Notifies the listeners of every instance of the ID of an event, once
+	// the transaction is committed
+	notifyTaskEvent, err = db.Preparex(`SELECT pg_notify('` + taskEventsChannel + `', $1);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the events after the event $1, optionally of the task $2, of
+	// the user $3 and of the project $4
+	selectTaskEvents, err = db.Preparex(`SELECT id, created_at, type, resource, task_id, user_id, project_id, actor_id, data FROM task_events
+		WHERE id > $1
+		AND ($2::integer IS NULL OR task_id = $2)
+		AND ($3::integer IS NULL OR user_id = $3)
+		AND ($4::integer IS NULL OR project_id = $4)
+		ORDER BY id
+		LIMIT $5;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectTaskEventWhereID, err = db.Preparex(`SELECT id, created_at, type, resource, task_id, user_id, project_id, actor_id, data FROM task_events WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteOldTaskEvents, err = db.Preparex(`DELETE FROM task_events WHERE created_at < now() - $1 * interval '1 second';`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The statements that change the viewers of tasks notify the listeners
+	// of every instance of the tasks whose presence changed
+	upsertTaskViewer, err = db.Preparex(`WITH viewer AS (
+			INSERT INTO task_viewers ("connection_id", "task_id", "user_id") VALUES ($1, $2, $3)
+			ON CONFLICT ("connection_id", "task_id") DO UPDATE SET seen_at = now()
+			RETURNING task_id
+		)
+		SELECT pg_notify('` + presenceChannel + `', task_id::text) FROM viewer;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	touchTaskViewers, err = db.Preparex(`UPDATE task_viewers SET seen_at = now() WHERE connection_id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Deletes the viewers of the connection $1, of the task $2 or of every task
+	deleteTaskViewers, err = db.Preparex(`WITH viewer AS (
+			DELETE FROM task_viewers WHERE connection_id = $1 AND ($2::integer IS NULL OR task_id = $2)
+			RETURNING task_id
+		)
+		SELECT pg_notify('` + presenceChannel + `', task_id::text) FROM viewer;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Deletes the viewers that weren't refreshed for $1 seconds
+	deleteStaleTaskViewers, err = db.Preparex(`WITH viewer AS (
+			DELETE FROM task_viewers WHERE seen_at < now() - $1 * interval '1 second'
+			RETURNING task_id
+		)
+		SELECT pg_notify('` + presenceChannel + `', task_id::text) FROM viewer;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectTaskViewers, err = db.Preparex(`SELECT DISTINCT users.id, users.username FROM task_viewers
+		JOIN users ON users.id = task_viewers.user_id
+		WHERE task_viewers.task_id = $1 AND task_viewers.seen_at >= now() - $2 * interval '1 second'
+		ORDER BY users.username;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertWebhook, err = db.Preparex(`INSERT INTO webhooks ("user_id", "project_id", "url", "events", "secret") VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, user_id, project_id, url, events;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectWebhooksWhereUserID, err = db.Preparex(`SELECT id, created_at, user_id, project_id, url, events FROM webhooks WHERE user_id = $1 ORDER BY id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectWebhookWhereID, err = db.Preparex(`SELECT id, created_at, user_id, project_id, url, events FROM webhooks WHERE id = $1 AND user_id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteWebhook, err = db.Preparex(`DELETE FROM webhooks WHERE id = $1 AND user_id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the webhooks of active users that subscribe to the event type
+	// $1, of the project $2 or of no project
+	selectEventWebhooks, err = db.Preparex(`SELECT webhooks.id, webhooks.user_id, webhooks.project_id FROM webhooks
+		JOIN users ON users.id = webhooks.user_id
+		WHERE users.deactivated_at IS NULL
+		AND $1 = ANY(webhooks.events)
+		AND (webhooks.project_id IS NULL OR webhooks.project_id = $2);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertWebhookDelivery, err = db.Preparex(`INSERT INTO webhook_deliveries ("webhook_id", "event_id", "event_type", "payload") VALUES ($1, $2, $3, $4);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectWebhookDeliveries, err = db.Preparex(`SELECT id, created_at, event_id, event_type, attempts, next_attempt_at, delivered_at, failed_at FROM webhook_deliveries
+		WHERE webhook_id = $1 AND id < $2
+		ORDER BY id DESC
+		LIMIT $3;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectWebhookAttempts, err = db.Preparex(`SELECT delivery_id, attempted_at, status_code, error, duration_ms FROM webhook_attempts
+		WHERE delivery_id = ANY($1)
+		ORDER BY id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Queues the delivery $1 of the webhook $2 again, as if it were new
+	redeliverWebhookDelivery, err = db.Preparex(`UPDATE webhook_deliveries SET attempts = 0, next_attempt_at = now(), delivered_at = NULL, failed_at = NULL
+		WHERE id = $1 AND webhook_id = $2
+		RETURNING id, created_at, event_id, event_type, attempts, next_attempt_at, delivered_at, failed_at;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Claims up to $2 pending deliveries for $1 seconds, in which they must
+	// be attempted. Instances skip the deliveries claimed by the others, and
+	// a delivery whose instance stopped is claimed again after that
+	claimWebhookDeliveries, err = db.Preparex(`UPDATE webhook_deliveries SET next_attempt_at = now() + $1 * interval '1 second'
+		FROM webhooks
+		WHERE webhooks.id = webhook_deliveries.webhook_id
+		AND webhook_deliveries.id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE delivered_at IS NULL AND failed_at IS NULL AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING webhook_deliveries.id, webhook_deliveries.event_type, webhook_deliveries.payload, webhook_deliveries.attempts, webhook_deliveries.next_attempt_at, webhooks.url, webhooks.secret;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertWebhookAttempt, err = db.Preparex(`INSERT INTO webhook_attempts ("delivery_id", "status_code", "error", "duration_ms") VALUES ($1, $2, $3, $4);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// The updates of the deliveries only apply while the instance that claimed
+	// the delivery $1 until $2 holds it: the claim can expire, and the delivery
+	// can be queued again
+	deliverWebhookDelivery, err = db.Preparex(`UPDATE webhook_deliveries SET attempts = attempts + 1, delivered_at = now()
+		WHERE id = $1 AND next_attempt_at = $2 AND delivered_at IS NULL AND failed_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Attempts the delivery $1 again in $3 seconds
+	retryWebhookDelivery, err = db.Preparex(`UPDATE webhook_deliveries SET attempts = attempts + 1, next_attempt_at = now() + $3 * interval '1 second'
+		WHERE id = $1 AND next_attempt_at = $2 AND delivered_at IS NULL AND failed_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failWebhookDelivery, err = db.Preparex(`UPDATE webhook_deliveries SET attempts = attempts + 1, failed_at = now()
+		WHERE id = $1 AND next_attempt_at = $2 AND delivered_at IS NULL AND failed_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Deletes the keys that haven't failed nor been locked for $1 seconds
+	deleteStaleAuthFailures, err = db.Preparex(`DELETE FROM auth_failures
+		WHERE GREATEST(failed_at, locked_until) < now() - $1 * interval '1 second';`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectProfileWhereID, err = db.Preparex(`SELECT id, created_at, username, name, deactivated_at FROM users WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateUserProfile, err = db.Preparex(`UPDATE users SET username = $1, name = $2 WHERE id = $3;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deactivateUser, err = db.Preparex(`UPDATE users SET deactivated_at = now() WHERE id = $1 AND deactivated_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	reactivateUser, err = db.Preparex(`UPDATE users SET deactivated_at = NULL WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateProjectMemberRole, err = db.Preparex(`UPDATE project_members SET role = $3 WHERE project_id = $1 AND user_id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectProjectMemberRole, err = db.Preparex(`SELECT role FROM project_members WHERE project_id = $1 AND user_id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the roles of the user $1 on the workspace and on the project $2,
+	// which can be null
+	selectRoles, err = db.Preparex(`SELECT role FROM workspace_roles WHERE user_id = $1
+		UNION ALL
+		SELECT role FROM project_members WHERE user_id = $1 AND project_id = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectWorkspaceRoles, err = db.Preparex(`SELECT users.id, users.username, workspace_roles.role FROM workspace_roles JOIN users ON workspace_roles.user_id = users.id
+		ORDER BY users.id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Returns the previous role of the user, or NULL
+	upsertWorkspaceRole, err = db.Preparex(`WITH previous AS (SELECT role FROM workspace_roles WHERE user_id = $1)
+		INSERT INTO workspace_roles ("user_id", "role") VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET role = EXCLUDED.role
+		RETURNING (SELECT role FROM previous);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteWorkspaceRole, err = db.Preparex(`DELETE FROM workspace_roles WHERE user_id = $1 RETURNING role;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Moves the task $2 and its subtasks to the project $1
+	updateTasksProjectID, err = db.Preparex(`UPDATE tasks SET project_id = $1, version = version + 1
+		WHERE id IN (WITH RECURSIVE subtree (id) AS (
+			SELECT $2::integer
+			UNION
+			SELECT tasks.id FROM tasks JOIN subtree ON tasks.parent_id = subtree.id
+		) SELECT id FROM subtree);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the subtasks of the task $1, and theirs, that are not in the trash
+	selectTaskDescendants, err = db.Preparex(selectTaskResources + `
+		WHERE tasks.id IN (WITH RECURSIVE subtree (id) AS (
+			SELECT tasks.id FROM tasks WHERE tasks.parent_id = $1
+			UNION
+			SELECT tasks.id FROM tasks JOIN subtree ON tasks.parent_id = subtree.id
+		) SELECT id FROM subtree) AND tasks.deleted_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertTaskTransition, err = db.Preparex(`INSERT INTO task_transitions ("task_id", "user_id", "from_status", "to_status") VALUES ($1, $2, $3, $4);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectTransitionsWhereTaskID, err = db.Preparex(`SELECT task_transitions.id, task_transitions.created_at, task_transitions.from_status, task_transitions.to_status, users.id AS "user.id", users.username AS "user.username"
+		FROM task_transitions JOIN users ON task_transitions.user_id = users.id
+		WHERE task_id = $1
+		ORDER BY task_transitions.created_at, task_transitions.id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Selects the tasks due in ($1, $2] that didn't get a $4 reminder for
+	// their current due date from the sink $5
+	selectPendingReminders, err = db.Preparex(`SELECT tasks.id AS task_id, tasks.due_at FROM tasks
+		WHERE tasks.deleted_at IS NULL AND tasks.due_at > $1 AND tasks.due_at <= $2 AND tasks.status <> ALL($3)
+		AND NOT EXISTS (SELECT 1 FROM reminders WHERE reminders.task_id = tasks.id AND reminders.due_at = tasks.due_at AND reminders.kind = $4 AND reminders.sink = $5)
+		ORDER BY tasks.due_at;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	claimReminder, err = db.Preparex(`INSERT INTO reminders ("task_id", "kind", "due_at", "sink", "status") VALUES ($1, $2, $3, $4, 'sending') ON CONFLICT DO NOTHING RETURNING id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	markReminderSent, err = db.Preparex(`UPDATE reminders SET status = 'sent' WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	releaseReminder, err = db.Preparex(`DELETE FROM reminders WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertLabel, err = db.Preparex(`INSERT INTO labels ("name", "color", "description") VALUES ($1, $2, $3) RETURNING id;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectLabels, err = db.Preparex(`SELECT id, created_at, updated_at, name, color, description FROM labels ORDER BY name;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectLabelWhereID, err = db.Preparex(`SELECT id, created_at, updated_at, name, color, description FROM labels WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectLabelNamesWhereName, err = db.Preparex(`SELECT name FROM labels WHERE name = ANY($1);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	updateLabel, err = db.Preparex(`UPDATE labels SET name = $1, color = $2, description = $3 WHERE id = $4;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteLabel, err = db.Preparex(`DELETE FROM labels WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Renaming or deleting a label changes the tasks that have it, so their
+	// Etag must change too
+	bumpTaskVersionsWhereLabelID, err = db.Preparex(`UPDATE tasks SET version = version + 1 WHERE id IN (SELECT task_id FROM task_labels WHERE label_id = $1);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	selectTasksWhereLabelID, err = db.Preparex(selectTaskResources + `
+		WHERE tasks.id IN (SELECT task_id FROM task_labels WHERE label_id = $1) AND tasks.deleted_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteTaskLabels, err = db.Preparex(`DELETE FROM task_labels WHERE task_id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	insertTaskLabels, err = db.Preparex(`INSERT INTO task_labels ("task_id", "label_id") SELECT $1, id FROM labels WHERE name = ANY($2);`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Writes to a task start by bumping its version, if it's still one of the
+	// versions accepted by If-Match (or any version if $2 is NULL). The row
+	// stays locked until the end of the transaction, so concurrent writers
+	// with the same Etag can't both succeed
+	bumpTaskVersion, err = db.Preparex(`UPDATE tasks SET version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL AND ($2::bigint[] IS NULL OR version = ANY($2::bigint[]));`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Comments deleted along with their task share its deleted_at, so that
+	// restoring the task only restores them
+	deleteTask, err = db.Preparex(`UPDATE tasks SET deleted_at = CURRENT_TIMESTAMP, version = version + 1
+		WHERE id = $1 AND deleted_at IS NULL AND ($2::bigint[] IS NULL OR version = ANY($2::bigint[]));`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	deleteCommentsWhereTaskID, err = db.Preparex(`UPDATE comments SET deleted_at = CURRENT_TIMESTAMP, version = version + 1 WHERE task_id = $1 AND deleted_at IS NULL;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	restoreTask, err = db.Preparex(`UPDATE tasks SET deleted_at = NULL, version = version + 1 WHERE id = $1;`)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	restoreCommentsWhereTaskID, err = db.Preparex(`UPDATE comments SET deleted_at = NULL, version = version + 1 WHERE task_id = $1 AND deleted_at = $2;`)
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 func seed() {
-	for _, user := range []User{
+	for _, user := range []struct {
+		Username, Token string
+	}{
 		{Username: "Alice", Token: "077000ac559e1ba0fe4f303b614f30da6306341f"},
 		{Username: "Bob", Token: "ef2e253a2b4564ae949b053025c845552f2e99cc"},
 	} {
-		insertUser.MustExec(user.Username, user.Token)
+		var userID int
+		if err := insertUser.Get(&userID, user.Username, ""); err != nil {
+			log.Fatal(err)
+		}
+		insertAPIToken.MustExec(userID, "default", hashToken(user.Token), nil, nil)
 	}
+	upsertWorkspaceRole.MustExec(1, "owner")
+	upsertWorkspaceRole.MustExec(2, "commenter")
 	for _, task := range []Task{
 		{Name: "First task", UserID: 1, Description: "This is the first task"},
 		{Name: "Second task", UserID: 1, Description: "This is the second task"},
 		{Name: "Third task", UserID: 2, Description: "This is the third task"},
 	} {
-		insertTask.MustExec(task.Name, task.UserID, task.Description, task.Progression)
+		var taskID int
+		if err := insertTask.Get(&taskID, task.Name, task.UserID, task.Description, task.Progression, workflow.Initial, nil, nil, nil, 1, nil); err != nil {
+			log.Fatal(err)
+		}
+		insertTaskTransition.MustExec(taskID, task.UserID, nil, workflow.Initial)
 	}
 	for _, comment := range []Comment{
 		{TaskID: 1, UserID: 1, Content: "This is the first comment"},
@@ -169,6 +1047,42 @@ func seed() {
 	}
 }
 
-func drop() {
-	db.MustExec(`DROP TABLE comments; DROP TABLE tasks; DROP TABLE users;`)
+// purgeTrash permanently deletes the tasks and comments that were deleted
+// before the given time
+func purgeTrash(before time.Time) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM comments WHERE deleted_at < $1 OR task_id IN (SELECT id FROM tasks WHERE deleted_at < $1);`, before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM task_dependencies WHERE task_id IN (SELECT id FROM tasks WHERE deleted_at < $1) OR blocker_id IN (SELECT id FROM tasks WHERE deleted_at < $1);`, before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM task_labels WHERE task_id IN (SELECT id FROM tasks WHERE deleted_at < $1);`, before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM reminders WHERE task_id IN (SELECT id FROM tasks WHERE deleted_at < $1);`, before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM task_transitions WHERE task_id IN (SELECT id FROM tasks WHERE deleted_at < $1);`, before); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM tasks WHERE deleted_at < $1;`, before); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// purgeTrashEvery calls purgeTrash periodically with the given retention
+// period. It never returns
+func purgeTrashEvery(interval, retention time.Duration) {
+	for {
+		if err := purgeTrash(time.Now().Add(-retention)); err != nil {
+			log.Printf("couldn't purge trash: %v", err)
+		}
+		time.Sleep(interval)
+	}
 }
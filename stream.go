@@ -0,0 +1,382 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/manucorporat/sse"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// taskEventsChannel is the channel on which the IDs of the task events are
+// notified
+const taskEventsChannel = "task_events"
+
+// taskEventsLockID is the key of the advisory lock that serializes the
+// transactions that record task events, from their first event to their
+// commit. Event IDs are thus in the order of the commits, so that subscribers
+// that saw an event have seen every event before it. Transactions record their
+// events after their other writes, so that they hold the lock briefly and
+// can't deadlock over rows
+const taskEventsLockID = 4245
+
+// taskEventRetention is how long task events are kept, for subscribers to
+// resume after a disconnect. It is set by the EVENT_RETENTION env
+var taskEventRetention = 24 * time.Hour
+
+// eventStreamHeartbeat is how often an idle stream sends a comment, so that
+// proxies such as the Heroku router don't close it
+var eventStreamHeartbeat = 30 * time.Second
+
+// eventStreamMaxAge is how long a stream lasts. Clients then reconnect, which
+// authenticates them again, and resume with the Last-Event-ID header
+var eventStreamMaxAge = 10 * time.Minute
+
+// taskEventResourceRegexp matches the paths of the tasks and of their comments
+// and dependencies, whose changes are task events
+var taskEventResourceRegexp = regexp.MustCompile(`^/tasks/([0-9]+)(/(comments|dependencies)/[0-9]+)?$`)
+
+// taskEventKinds are the kinds of the resources of task events, by path segment
+var taskEventKinds = map[string]string{"": "task", "comments": "comment", "dependencies": "dependency"}
+
+// publishTaskEvent records an event of a change of a task, or of its comments
+// or dependencies, in tx. Its type is the kind of the resource and the action,
+// e.g. comment.create, and its data is the resource after the change, or
+// before it if it was deleted. The event is also queued for delivery to the
+// webhooks that subscribe to it. Changes of other resources are ignored
+func publishTaskEvent(tx *sqlx.Tx, action, resource string, actorID *int, before, after *string) error {
+	match := taskEventResourceRegexp.FindStringSubmatch(resource)
+	if match == nil {
+		return nil
+	}
+	taskID, _ := strconv.Atoi(match[1])
+	data := after
+	if data == nil {
+		data = before
+	}
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, taskEventsLockID); err != nil {
+		return err
+	}
+	var event TaskEventResource
+	err := tx.Stmtx(insertTaskEvent).Get(&event, taskEventKinds[match[3]]+"."+action, resource, taskID, actorID, data)
+	if err == sql.ErrNoRows {
+		// The task was purged
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Stmtx(notifyTaskEvent).Exec(strconv.Itoa(event.ID)); err != nil {
+		return err
+	}
+	return enqueueWebhookDeliveries(tx, event)
+}
+
+// taskEventFilter selects the events of a task, of the tasks of a user or of
+// the tasks of a project, and of a kind of resource, e.g. comment. Zero fields
+// select every event
+type taskEventFilter struct {
+	taskID, userID, projectID *int
+	kind                      string
+}
+
+func (f taskEventFilter) matches(event TaskEventResource) bool {
+	equal := func(filter *int, value *int) bool {
+		return filter == nil || value != nil && *value == *filter
+	}
+	return equal(f.taskID, &event.TaskID) && equal(f.userID, &event.UserID) && equal(f.projectID, event.ProjectID) &&
+		(f.kind == "" || strings.HasPrefix(event.Type, f.kind+"."))
+}
+
+// taskEventSubscriber is a client of GET /events, or a subscription of a
+// client of GET /ws. events is closed when it is unsubscribed, and dropped is
+// then set if it was because the subscriber didn't keep up
+type taskEventSubscriber struct {
+	user    User
+	filter  taskEventFilter
+	events  chan TaskEventResource
+	dropped bool
+}
+
+// sendMissed sends the events that the subscriber missed after the event
+// lastID, and returns the ID of the last one
+func (s *taskEventSubscriber) sendMissed(lastID int, send func(TaskEventResource)) (int, error) {
+	for {
+		var missed []TaskEventResource
+		if err := selectTaskEvents.Select(&missed, lastID, s.filter.taskID, s.filter.userID, s.filter.projectID, maxLimit); err != nil {
+			return lastID, err
+		}
+		for _, event := range missed {
+			if !s.filter.matches(event) {
+				continue
+			}
+			ok, err := s.canView(event)
+			if err != nil {
+				return lastID, err
+			}
+			if ok {
+				send(event)
+			}
+			lastID = event.ID
+		}
+		if len(missed) < maxLimit {
+			return lastID, nil
+		}
+	}
+}
+
+// canView tells whether the subscriber can view the task of an event, and its
+// comments if the event is about one
+func (s *taskEventSubscriber) canView(event TaskEventResource) (bool, error) {
+	if strings.HasPrefix(event.Type, "comment.") && !s.user.scopes.has("comments:read") {
+		return false, nil
+	}
+	task := TaskResource{User: UserResource{Resource: Resource{ID: event.UserID}}, ProjectID: event.ProjectID}
+	role, err := taskRole(s.user, &task)
+	return allows(role, taskView), err
+}
+
+// taskEventBroker fans out the task events of every instance to the
+// subscribers of this one
+type taskEventBroker struct {
+	sync.Mutex
+	subscribers map[*taskEventSubscriber]bool
+}
+
+var broker = &taskEventBroker{subscribers: map[*taskEventSubscriber]bool{}}
+
+func (b *taskEventBroker) subscribe(s *taskEventSubscriber) {
+	b.Lock()
+	defer b.Unlock()
+	b.subscribers[s] = true
+}
+
+func (b *taskEventBroker) unsubscribe(s *taskEventSubscriber) {
+	b.Lock()
+	defer b.Unlock()
+	if b.subscribers[s] {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+// publish sends an event to the subscribers that select it and can view it.
+// Subscribers that are too slow to keep up are unsubscribed, so that they
+// resume from the events they missed when they reconnect
+func (b *taskEventBroker) publish(event TaskEventResource) {
+	b.Lock()
+	var subscribers []*taskEventSubscriber
+	for s := range b.subscribers {
+		if s.filter.matches(event) {
+			subscribers = append(subscribers, s)
+		}
+	}
+	b.Unlock()
+
+	for _, s := range subscribers {
+		ok, err := s.canView(event)
+		if err != nil {
+			log.Printf("couldn't select roles: %v", err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		b.Lock()
+		if b.subscribers[s] {
+			select {
+			case s.events <- event:
+			default:
+				delete(b.subscribers, s)
+				s.dropped = true
+				close(s.events)
+			}
+		}
+		b.Unlock()
+	}
+}
+
+// listenTaskEvents publishes the task events and the presence changes notified
+// by every instance to the subscribers of this one, and wakes up the delivery
+// of webhooks. After reconnecting, it publishes the events it missed and the
+// current presence. It never returns
+func listenTaskEvents(databaseURL string) {
+	listener := pq.NewListener(databaseURL, time.Second, time.Minute, func(_ pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("task events listener: %v", err)
+		}
+	})
+	for _, channel := range []string{taskEventsChannel, presenceChannel} {
+		if err := listener.Listen(channel); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	lastID := 0
+	if err := db.Get(&lastID, `SELECT COALESCE(MAX(id), 0) FROM task_events`); err != nil {
+		log.Fatal(err)
+	}
+	for {
+		select {
+		case n := <-listener.Notify:
+			var events []TaskEventResource
+			if n == nil {
+				// The connection was lost, and the notifications with it
+				for afterID := lastID; ; {
+					var page []TaskEventResource
+					if err := selectTaskEvents.Select(&page, afterID, nil, nil, nil, maxLimit); err != nil {
+						log.Printf("couldn't select from task_events: %v", err)
+						break
+					}
+					events = append(events, page...)
+					if len(page) < maxLimit {
+						break
+					}
+					afterID = page[len(page)-1].ID
+				}
+				hub.publishAllPresence()
+			} else if n.Channel == presenceChannel {
+				taskID, _ := strconv.Atoi(n.Extra)
+				hub.publishPresence(taskID)
+			} else {
+				id, _ := strconv.Atoi(n.Extra)
+				var event TaskEventResource
+				if err := selectTaskEventWhereID.Get(&event, id); err != nil {
+					log.Printf("couldn't select from task_events: %v", err)
+					continue
+				}
+				events = append(events, event)
+			}
+			if len(events) > 0 {
+				wakeWebhooks()
+			}
+			for _, event := range events {
+				broker.publish(event)
+				if event.ID > lastID {
+					lastID = event.ID
+				}
+			}
+		case <-time.After(time.Minute):
+			go listener.Ping()
+		}
+	}
+}
+
+// intParam returns the integer query parameter name, or nil if it is missing.
+// It answers and returns false if it is malformed
+func intParam(c *gin.Context, name string) (*int, bool) {
+	v, ok := c.GetQuery(name)
+	if !ok {
+		return nil, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, &ParamError{name, "must be an integer"})
+		return nil, false
+	}
+	return &n, true
+}
+
+// getEventsHandler streams the task events that the user can view as
+// Server-Sent Events, optionally of a task (task_id), of the tasks of a user
+// (user_id) or of the tasks of a project (project_id). Clients that send the
+// Last-Event-ID header first get the events they missed since that event
+func getEventsHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var filter taskEventFilter
+	if filter.taskID, ok = intParam(c, "task_id"); !ok {
+		return
+	}
+	if filter.userID, ok = intParam(c, "user_id"); !ok {
+		return
+	}
+	if filter.projectID, ok = intParam(c, "project_id"); !ok {
+		return
+	}
+	lastID := -1
+	if v := c.Request.Header.Get("Last-Event-ID"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: "Last-Event-ID", Message: "must be the ID of an event"})
+			return
+		}
+		lastID = n
+	}
+
+	// Subscribe before selecting the missed events, so that none is lost in
+	// between
+	s := &taskEventSubscriber{user: user, filter: filter, events: make(chan TaskEventResource, 64)}
+	broker.subscribe(s)
+	defer broker.unsubscribe(s)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Content-Type", sse.ContentType)
+	// Disables the buffering of proxies such as nginx
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.WriteHeaderNow()
+	c.Writer.Flush()
+
+	send := func(event TaskEventResource) {
+		c.Render(-1, sse.Event{Id: strconv.Itoa(event.ID), Event: event.Type, Data: event})
+	}
+	if lastID >= 0 {
+		var err error
+		if lastID, err = s.sendMissed(lastID, send); err != nil {
+			log.Printf("couldn't send the missed task events: %v", err)
+			return
+		}
+		c.Writer.Flush()
+	}
+
+	heartbeat := time.NewTicker(eventStreamHeartbeat)
+	defer heartbeat.Stop()
+	maxAge := time.NewTimer(eventStreamMaxAge)
+	defer maxAge.Stop()
+	clientGone := c.Writer.CloseNotify()
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				return
+			}
+			// The missed events may already have included it
+			if event.ID <= lastID {
+				continue
+			}
+			send(event)
+			lastID = event.ID
+		case <-heartbeat.C:
+			io.WriteString(c.Writer, ":\n\n")
+		case <-maxAge.C:
+			return
+		case <-clientGone:
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+// purgeTaskEventsEvery deletes the task events older than the retention
+// periodically. It never returns
+func purgeTaskEventsEvery(interval time.Duration) {
+	for {
+		if _, err := deleteOldTaskEvents.Exec(int(taskEventRetention.Seconds())); err != nil {
+			log.Printf("couldn't purge task_events: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
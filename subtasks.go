@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// taskTreeLockID is the key of the advisory lock that serializes the moves of
+// tasks between parents, so that two concurrent moves can't build a cycle
+const taskTreeLockID = 4243
+
+// checkParentID is the check of the parent_id field. The parent must be a task
+// that isn't in the trash, that the user can edit, and that isn't the task
+// itself or one of its subtasks
+func checkParentID(ctx *taskPatchContext, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+	id, ok := value.(float64)
+	if !ok || id != float64(int(id)) {
+		return nil, fmt.Errorf("must be a task ID or null")
+	}
+	parentID := int(id)
+
+	var parent TaskResource
+	err := selectTaskWhereID.Get(&parent, parentID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("task %d doesn't exist", parentID)
+	}
+	if err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		return nil, fmt.Errorf("couldn't check the parent")
+	}
+	if err := checkScope(ctx.user, projectScope(parent.ProjectID)); err != nil {
+		return nil, err
+	}
+	role, err := taskRole(ctx.user, &parent)
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		return nil, fmt.Errorf("couldn't check the parent")
+	}
+	if !allows(role, taskEdit) {
+		return nil, fmt.Errorf("you can't edit task %d", parentID)
+	}
+	if err := checkCycle(selectTaskIsAncestor, ctx.task.ID, parentID); err != nil {
+		return nil, err
+	}
+	return parentID, nil
+}
+
+// updateParentID is the update of the parent_id field. The cycle check is
+// repeated under the lock, because the tree may have changed since the patch
+// was checked
+func updateParentID(tx *sqlx.Tx, ctx *taskPatchContext, value interface{}) error {
+	if value != nil {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, taskTreeLockID); err != nil {
+			return err
+		}
+		if err := checkCycle(tx.Stmtx(selectTaskIsAncestor), ctx.task.ID, value.(int)); err != nil {
+			return &FieldError{Field: "parent_id", Message: err.Error()}
+		}
+	}
+	_, err := tx.Stmtx(updateTasksParentID).Exec(value, ctx.task.ID)
+	return err
+}
+
+// checkCycle returns an error if making parentID the parent of taskID would
+// build a cycle. stmt is selectTaskIsAncestor, possibly in a transaction
+func checkCycle(stmt *sqlx.Stmt, taskID, parentID int) error {
+	var cycle bool
+	if err := stmt.Get(&cycle, parentID, taskID); err != nil {
+		log.Printf("couldn't select from tasks: %v", err)
+		return fmt.Errorf("couldn't check the parent")
+	}
+	if cycle {
+		return fmt.Errorf("task %d can't be its own ancestor", taskID)
+	}
+	return nil
+}
+
+// rollupProgression recomputes the progression of a task from its subtasks,
+// then the progression of its ancestors, as long as it changes. taskID can be
+// nil when the task that changed has no parent. A task without subtasks left
+// keeps the progression they had, since its own was replaced by theirs. It
+// returns the tasks it changed as they were before, so that their changes can
+// be recorded
+func rollupProgression(tx *sqlx.Tx, taskID *int) ([]TaskResource, error) {
+	var changed []TaskResource
+	for taskID != nil {
+		// The task is locked before its subtasks are aggregated, so that
+		// concurrent changes of its subtasks roll it up one after the other,
+		// each from the other's committed write
+		if _, err := tx.Stmtx(lockTaskWhereID).Exec(*taskID); err != nil {
+			return nil, err
+		}
+		// Tasks in the trash are rolled up too, but have no revisions
+		var before TaskResource
+		err := tx.Stmtx(selectTaskWhereID).Get(&before, *taskID)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+		trashed := err == sql.ErrNoRows
+		var parentID sql.NullInt64
+		err = tx.Stmtx(rollupTaskProgression).Get(&parentID, *taskID)
+		if err == sql.ErrNoRows {
+			return changed, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !trashed {
+			changed = append(changed, before)
+		}
+		taskID = nil
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			taskID = &id
+		}
+	}
+	return changed, nil
+}
+
+func getTasksIDSubtasksHandler(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	listTasks(c, func(query *taskQuery) {
+		query.Where("tasks.parent_id = ?", id)
+	})
+}
+
+func postTasksIDSubtasksHandler(c *gin.Context) {
+	user, exists := c.Get(gin.AuthUserKey)
+	if !exists {
+		log.Print("No user in POST /tasks/:id/subtasks handler context")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	parentID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	var task Task
+	if err := c.BindJSON(&task); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	// The creator isn't the client's to choose
+	task.UserID = user.(User).ID
+	task.ParentID = &parentID
+	createTask(c, user.(User), &task)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// tokenRotationGrace is how long a rotated token keeps working, so that its
+// clients have time to switch to the new one. It is set by the
+// TOKEN_ROTATION_GRACE env
+var tokenRotationGrace = 24 * time.Hour
+
+// newToken returns a random API token
+func newToken() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// hashToken returns the hash of a token, which is all the database stores.
+// Tokens are random, so they need neither a salt nor a slow hash. Tokens are
+// looked up by their hash, so the timing of the lookup can't leak a token
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// selectTokenUser selects the user of a token, with the scopes of the token.
+// bearer tells whether it is an OAuth access token rather than an API token.
+// It returns sql.ErrNoRows if the token doesn't work
+func selectTokenUser(token string, bearer bool) (User, error) {
+	var auth struct {
+		User
+		TokenID int            `db:"token_id"`
+		Scopes  pq.StringArray `db:"scopes"`
+	}
+	if err := selectUserWhereTokenHash.Get(&auth, hashToken(token), bearer); err != nil {
+		return User{}, err
+	}
+	if _, err := touchAPIToken.Exec(auth.TokenID); err != nil {
+		log.Printf("couldn't update api_tokens: %v", err)
+	}
+	auth.User.scopes = tokenScopes(auth.Scopes)
+	auth.User.bearer = bearer
+	return auth.User, nil
+}
+
+// mintToken creates a token for a user, and returns its ID and the token
+// itself. nil scopes grant every scope
+func mintToken(tx *sqlx.Tx, userID int, name string, expiresAt *time.Time, scopes tokenScopes) (int, string, error) {
+	token, err := newToken()
+	if err != nil {
+		return 0, "", err
+	}
+	var tokenID int
+	if err := tx.Stmtx(insertAPIToken).Get(&tokenID, userID, name, hashToken(token), expiresAt, pq.StringArray(scopes)); err != nil {
+		return 0, "", err
+	}
+	return tokenID, token, nil
+}
+
+// answerMintedToken records a token that was just minted in the audit log,
+// commits tx and answers 201 Created with the token. This is the only time the
+// token is shown
+func answerMintedToken(c *gin.Context, tx *sqlx.Tx, user User, tokenID int, token string) {
+	var minted struct {
+		TokenResource
+		Token string `json:"token"`
+	}
+	if err := tx.Stmtx(selectAPITokenWhereID).Get(&minted.TokenResource, tokenID, user.ID); err != nil {
+		log.Printf("couldn't select from api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "create", "/tokens/"+strconv.Itoa(tokenID), nil, minted.TokenResource, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	minted.Token = token
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", "/tokens/"+strconv.Itoa(tokenID))
+	c.JSON(http.StatusCreated, minted)
+}
+
+// selectToken selects the token of the id parameter, if it belongs to the
+// authenticated user. It answers and returns false otherwise
+func selectToken(c *gin.Context, token *TokenResource) (User, bool) {
+	user, ok := authUser(c)
+	if !ok {
+		return User{}, false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return User{}, false
+	}
+
+	err = selectAPITokenWhereID.Get(token, id, user.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return User{}, false
+	}
+	if err != nil {
+		log.Printf("couldn't select from api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return User{}, false
+	}
+	return user, true
+}
+
+// getTokensHandler lists the tokens of the authenticated user, including the
+// revoked and expired ones
+func getTokensHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	tokens := []TokenResource{}
+	if err := selectAPITokensWhereUserID.Select(&tokens, user.ID); err != nil {
+		log.Printf("couldn't select from api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// postTokensHandler mints a token for the authenticated user, which never
+// expires unless it has an expires_at date. Without scopes, it has the scopes
+// of the token used to mint it, and it can't have more
+func postTokensHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		Name      string     `json:"name" binding:"required"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Scopes    []string   `json:"scopes"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if body.ExpiresAt != nil && !body.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "expires_at", Message: "must be in the future"})
+		return
+	}
+	requested := user.scopes
+	if body.Scopes != nil {
+		if err := checkScopes(body.Scopes); err != nil {
+			c.JSON(http.StatusBadRequest, err)
+			return
+		}
+		requested = tokenScopes(body.Scopes)
+		if scope := user.scopes.missing(requested); scope != "" && !authorizeScope(c, user, scope) {
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	tokenID, token, err := mintToken(tx, user.ID, body.Name, body.ExpiresAt, requested)
+	if err != nil {
+		log.Printf("couldn't insert to api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	answerMintedToken(c, tx, user, tokenID, token)
+}
+
+// deleteTokensIDHandler revokes a token of the authenticated user. It stops
+// working immediately
+func deleteTokensIDHandler(c *gin.Context) {
+	var token TokenResource
+	user, ok := selectToken(c, &token)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmtx(revokeAPIToken).Exec(token.ID); err != nil {
+		log.Printf("couldn't update api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var revoked TokenResource
+	if err := tx.Stmtx(selectAPITokenWhereID).Get(&revoked, token.ID, user.ID); err != nil {
+		log.Printf("couldn't select from api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "delete", "/tokens/"+strconv.Itoa(token.ID), token, revoked, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// postTokensIDRotateHandler mints a token that replaces another one, with the
+// same name, expiry and scopes. The old token keeps working during the rotation
+// grace period, unless it expires before. A token can't rotate another one with
+// more scopes than its own
+func postTokensIDRotateHandler(c *gin.Context) {
+	var old TokenResource
+	user, ok := selectToken(c, &old)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	if old.RevokedAt != nil || old.ExpiresAt != nil && !old.ExpiresAt.After(now) {
+		c.JSON(http.StatusBadRequest, &FieldError{Field: "id", Message: "the token is revoked or expired"})
+		return
+	}
+	if scope := user.scopes.missing(tokenScopes(old.Scopes)); scope != "" && !authorizeScope(c, user, scope) {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	tokenID, token, err := mintToken(tx, user.ID, old.Name, old.ExpiresAt, tokenScopes(old.Scopes))
+	if err != nil {
+		log.Printf("couldn't insert to api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(expireAPIToken).Exec(old.ID, now.Add(tokenRotationGrace)); err != nil {
+		log.Printf("couldn't update api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var rotated TokenResource
+	if err := tx.Stmtx(selectAPITokenWhereID).Get(&rotated, old.ID, user.ID); err != nil {
+		log.Printf("couldn't select from api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "rotate", "/tokens/"+strconv.Itoa(old.ID), old, rotated, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	answerMintedToken(c, tx, user, tokenID, token)
+}
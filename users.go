@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// signupMode is how users are created: "admin" when only admins can create
+// them, "open" when anyone can sign up. It is set by the SIGNUP_MODE env
+var signupMode = "admin"
+
+// signupRole is the workspace role of new users, unless an admin chooses
+// another one
+const signupRole = "commenter"
+
+var usernameRegexp = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,40}$`)
+
+// checkUsername returns a *FieldError unless username is valid. Usernames are
+// unique regardless of their case, which the database enforces
+func checkUsername(username string) error {
+	if !usernameRegexp.MatchString(username) {
+		return &FieldError{Field: "username", Message: "must be 1 to 40 letters, digits, dots, dashes or underscores"}
+	}
+	return nil
+}
+
+// postUsersHandler creates a user and answers with their first token, which
+// can't be fetched again. With a password, the user can also log in to start a
+// session. In the admin signup mode, only admins can create
+// users. In the open mode, anyone can sign up. New users are commenters, unless
+// an admin grants them another workspace role
+func postUsersHandler(c *gin.Context) {
+	role := ""
+	_, cookieErr := c.Request.Cookie(sessionCookieName)
+	if signupMode != "open" || c.Request.Header.Get("Authorization") != "" || cookieErr == nil {
+		authMiddleware("users:write")(c)
+		if c.IsAborted() {
+			return
+		}
+		user, ok := authUser(c)
+		if !ok {
+			return
+		}
+		var err error
+		if role, err = projectRole(user, nil); err != nil {
+			log.Printf("couldn't select roles: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	if signupMode != "open" && !allows(role, userManage) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	var body struct {
+		Username string  `json:"username" binding:"required"`
+		Name     string  `json:"name"`
+		Role     string  `json:"role"`
+		Password *string `json:"password"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if body.Role == "" {
+		body.Role = signupRole
+	}
+	if err := checkUsername(body.Username); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if err := checkRole(body.Role); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if body.Password != nil {
+		if err := checkPassword(*body.Password); err != nil {
+			c.JSON(http.StatusBadRequest, err)
+			return
+		}
+	}
+	if body.Role != signupRole && !canGrant(role, body.Role) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var userID int
+	err = tx.Stmtx(insertUser).Get(&userID, body.Username, body.Name)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, &FieldError{Field: "username", Message: "already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't insert to users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Stmtx(upsertWorkspaceRole).Exec(userID, body.Role); err != nil {
+		log.Printf("couldn't insert to workspace_roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if body.Password != nil {
+		passwordHash, err := bcrypt.GenerateFromPassword([]byte(*body.Password), bcrypt.DefaultCost)
+		if err != nil {
+			log.Printf("couldn't hash a password: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Stmtx(updateUserPassword).Exec(string(passwordHash), userID); err != nil {
+			log.Printf("couldn't update users: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	_, token, err := mintToken(tx, userID, "default", nil, nil)
+	if err != nil {
+		log.Printf("couldn't insert to api_tokens: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var created ProfileResource
+	if err := tx.Stmtx(selectProfileWhereID).Get(&created, userID); err != nil {
+		log.Printf("couldn't select from users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "create", "/users/"+strconv.Itoa(userID), nil, gin.H{"profile": created, "role": body.Role}, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", "/users/"+strconv.Itoa(userID))
+	c.JSON(http.StatusCreated, gin.H{"id": userID, "username": body.Username, "name": body.Name, "role": body.Role, "token": token})
+}
+
+// selectProfile selects the profile of the user of the id parameter. It
+// answers and returns false if there is none
+func selectProfile(c *gin.Context, profile *ProfileResource) bool {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return false
+	}
+
+	err = selectProfileWhereID.Get(profile, id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return false
+	}
+	if err != nil {
+		log.Printf("couldn't select from users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// selectManagedProfile selects the profile of the user of the id parameter,
+// and checks that the authenticated user can manage their account: either it's
+// theirs and self is true, or they can manage users and the user isn't above
+// them. It answers and returns false otherwise
+func selectManagedProfile(c *gin.Context, profile *ProfileResource, self bool) (User, bool) {
+	user, ok := authUser(c)
+	if !ok {
+		return User{}, false
+	}
+	if !selectProfile(c, profile) {
+		return User{}, false
+	}
+	if self && profile.ID == user.ID {
+		return user, true
+	}
+
+	role, err := projectRole(user, nil)
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return User{}, false
+	}
+	target, err := projectRole(User{Model: Model{ID: profile.ID}}, nil)
+	if err != nil {
+		log.Printf("couldn't select roles: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return User{}, false
+	}
+	if !canManageUser(role, target) {
+		c.AbortWithStatus(http.StatusForbidden)
+		return User{}, false
+	}
+	return user, true
+}
+
+// getUsersIDHandler answers the profile of a user. Users can always view their
+// own profile
+func getUsersIDHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var profile ProfileResource
+	if !selectProfile(c, &profile) {
+		return
+	}
+	if profile.ID != user.ID {
+		if _, ok := authorizeWorkspace(c, user, workspaceView); !ok {
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, profile)
+}
+
+// patchUsersIDHandler applies a JSON Merge Patch to the profile of a user
+func patchUsersIDHandler(c *gin.Context) {
+	var profile ProfileResource
+	if _, ok := selectManagedProfile(c, &profile, true); !ok {
+		return
+	}
+
+	var changed User
+	if !bindMergePatch(c, &profile, []string{"username", "name"}, &changed) {
+		return
+	}
+	if err := checkUsername(changed.Username); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Stmtx(updateUserProfile).Exec(changed.Username, changed.Name, profile.ID)
+	if isUniqueViolation(err) {
+		c.JSON(http.StatusConflict, &FieldError{Field: "username", Message: "already exists"})
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't update users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var after ProfileResource
+	if err := tx.Stmtx(selectProfileWhereID).Get(&after, profile.ID); err != nil {
+		log.Printf("couldn't select from users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "update", "/users/"+strconv.Itoa(profile.ID), profile, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// postUsersIDDeactivateHandler deactivates a user, whose tokens stop working.
+// Their tasks and comments are kept. Users can deactivate themselves, except
+// the owners of the workspace, so that it always keeps an active owner
+func postUsersIDDeactivateHandler(c *gin.Context) {
+	var profile ProfileResource
+	user, ok := selectManagedProfile(c, &profile, true)
+	if !ok {
+		return
+	}
+	if profile.ID == user.ID {
+		role, err := projectRole(user, nil)
+		if err != nil {
+			log.Printf("couldn't select roles: %v", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if role == "owner" {
+			c.JSON(http.StatusBadRequest, &FieldError{Field: "id", Message: "the owners of the workspace can't deactivate themselves"})
+			return
+		}
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmtx(deactivateUser).Exec(profile.ID); err != nil {
+		log.Printf("couldn't update users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var after ProfileResource
+	if err := tx.Stmtx(selectProfileWhereID).Get(&after, profile.ID); err != nil {
+		log.Printf("couldn't select from users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "deactivate", "/users/"+strconv.Itoa(profile.ID), profile, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// postUsersIDReactivateHandler reactivates a user, whose tokens work again
+func postUsersIDReactivateHandler(c *gin.Context) {
+	var profile ProfileResource
+	if _, ok := selectManagedProfile(c, &profile, false); !ok {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmtx(reactivateUser).Exec(profile.ID); err != nil {
+		log.Printf("couldn't update users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var after ProfileResource
+	if err := tx.Stmtx(selectProfileWhereID).Get(&after, profile.ID); err != nil {
+		log.Printf("couldn't select from users: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "reactivate", "/users/"+strconv.Itoa(profile.ID), profile, after, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
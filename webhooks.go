@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// webhookEventTypes are the types of the task events that webhooks can
+// subscribe to
+var webhookEventTypes = []string{
+	"task.create", "task.update", "task.delete", "task.restore", "task.revert",
+	"comment.create",
+	"dependency.create", "dependency.delete",
+}
+
+const (
+	// webhookTimeout is how long a webhook can take to answer
+	webhookTimeout = 10 * time.Second
+	// webhookBatch is how many deliveries are claimed at once
+	webhookBatch = 20
+	// webhookLease is how long an instance has to attempt the deliveries it
+	// claimed, before the others can claim them again. The deliveries of a
+	// batch are attempted one after another, so it lasts longer than a batch
+	// can take
+	webhookLease = webhookBatch*webhookTimeout + time.Minute
+	// webhookMaxAttempts is how many times a delivery is attempted before it
+	// fails
+	webhookMaxAttempts = 8
+)
+
+// webhookBackoff is how long the delivery of an event waits after its first
+// failed attempt. The wait doubles after each failed attempt
+var webhookBackoff = 30 * time.Second
+
+// webhookAllowInternal tells whether deliveries can be posted to loopback,
+// private and link-local addresses. It is set by the WEBHOOK_ALLOW_INTERNAL
+// env, for receivers on the same network
+var webhookAllowInternal = false
+
+// checkWebhookAddress denies the addresses of the internal network, such as
+// the metadata endpoints of cloud providers, unless webhookAllowInternal.
+// It is checked when connecting, so that a host can't resolve to another
+// address after it was checked
+func checkWebhookAddress(network, address string, _ syscall.RawConn) error {
+	if webhookAllowInternal {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return fmt.Errorf("%s is an internal address", host)
+	}
+	return nil
+}
+
+// webhookClient posts the deliveries. It doesn't follow redirects, which are
+// failed attempts, nor connects to internal addresses
+var webhookClient = &http.Client{
+	Timeout: webhookTimeout,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: checkWebhookAddress}).DialContext,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// webhookWake wakes up deliverWebhooksEvery when there may be new deliveries
+var webhookWake = make(chan struct{}, 1)
+
+// wakeWebhooks wakes up deliverWebhooksEvery, unless it is already awake
+func wakeWebhooks() {
+	select {
+	case webhookWake <- struct{}{}:
+	default:
+	}
+}
+
+// checkWebhookURL returns a *FieldError unless uri is an absolute http or
+// https URL
+func checkWebhookURL(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return &FieldError{Field: "url", Message: "must be an absolute http or https URL"}
+	}
+	return nil
+}
+
+// checkWebhookEvents returns a *FieldError unless events are known event types
+func checkWebhookEvents(events []string) error {
+	if len(events) == 0 {
+		return &FieldError{Field: "events", Message: "must not be empty"}
+	}
+	for _, event := range events {
+		known := false
+		for _, t := range webhookEventTypes {
+			known = known || t == event
+		}
+		if !known {
+			return &FieldError{Field: "events", Message: fmt.Sprintf("%q is not an event type", event)}
+		}
+	}
+	return nil
+}
+
+// signWebhook returns the signature of a delivery: the hex encoded HMAC-SHA256
+// of its timestamp, a dot and its body, keyed with the secret of the webhook
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// enqueueWebhookDeliveries queues the delivery of a task event to the webhooks
+// that subscribe to it, in tx. The webhooks of a project get the events of its
+// tasks, and the other webhooks the events of the tasks that their owner can
+// view
+func enqueueWebhookDeliveries(tx *sqlx.Tx, event TaskEventResource) error {
+	var webhooks []struct {
+		ID        int
+		UserID    int  `db:"user_id"`
+		ProjectID *int `db:"project_id"`
+	}
+	if err := tx.Stmtx(selectEventWebhooks).Select(&webhooks, event.Type, event.ProjectID); err != nil {
+		return err
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	task := TaskResource{User: UserResource{Resource: Resource{ID: event.UserID}}, ProjectID: event.ProjectID}
+	for _, webhook := range webhooks {
+		if webhook.ProjectID == nil {
+			role, err := taskRole(User{Model: Model{ID: webhook.UserID}}, &task)
+			if err != nil {
+				return err
+			}
+			if !allows(role, taskView) {
+				continue
+			}
+		}
+		if _, err := tx.Stmtx(insertWebhookDelivery).Exec(webhook.ID, event.ID, event.Type, string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getWebhooksHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	webhooks := []WebhookResource{}
+	if err := selectWebhooksWhereUserID.Select(&webhooks, user.ID); err != nil {
+		log.Printf("couldn't select from webhooks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// postWebhooksHandler registers a webhook. It gets the events of the tasks of
+// a project if project_id is set, which needs to manage the project, or else
+// the events of the tasks that the user can view, which needs to be a
+// workspace admin. Its secret signs the
+// deliveries, and can't be fetched again
+func postWebhooksHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	var body struct {
+		URL       string   `json:"url" binding:"required"`
+		Events    []string `json:"events"`
+		ProjectID *int     `json:"project_id"`
+	}
+	if err := c.BindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if err := checkWebhookURL(body.URL); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if err := checkWebhookEvents(body.Events); err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+	if body.ProjectID != nil {
+		if _, ok := authorizeProject(c, user, *body.ProjectID, projectManage); !ok {
+			return
+		}
+	} else if _, ok := authorizeWorkspace(c, user, webhookManage); !ok {
+		return
+	}
+
+	var registered struct {
+		WebhookResource
+		Secret string `json:"secret"`
+	}
+	secret, err := newToken()
+	if err != nil {
+		log.Printf("couldn't generate a webhook secret: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	registered.Secret = secret
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = tx.Stmtx(insertWebhook).Get(&registered.WebhookResource, user.ID, body.ProjectID, body.URL, pq.StringArray(body.Events), secret)
+	if err != nil {
+		log.Printf("couldn't insert to webhooks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "create", "/webhooks/"+strconv.Itoa(registered.ID), nil, registered.WebhookResource, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Header("Location", "/webhooks/"+strconv.Itoa(registered.ID))
+	c.JSON(http.StatusCreated, registered)
+}
+
+// selectWebhook selects the webhook of the id param, if the authenticated user
+// registered it. It answers and returns false otherwise
+func selectWebhook(c *gin.Context, webhook *WebhookResource) bool {
+	user, ok := authUser(c)
+	if !ok {
+		return false
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return false
+	}
+	err = selectWebhookWhereID.Get(webhook, id, user.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return false
+	}
+	if err != nil {
+		log.Printf("couldn't select from webhooks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// deleteWebhooksIDHandler deletes a webhook registered by the authenticated
+// user, with its deliveries
+func deleteWebhooksIDHandler(c *gin.Context) {
+	var webhook WebhookResource
+	if !selectWebhook(c, &webhook) {
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Stmtx(deleteWebhook).Exec(webhook.ID, webhook.UserID); err != nil {
+		log.Printf("couldn't delete from webhooks: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := audit(c, tx, "delete", "/webhooks/"+strconv.Itoa(webhook.ID), webhook, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	c.Data(http.StatusNoContent, "", nil)
+}
+
+// getWebhooksIDDeliveriesHandler answers the deliveries of a webhook, newest
+// first, with the log of their attempts. They are paginated like tasks, with
+// limit and cursor
+func getWebhooksIDDeliveriesHandler(c *gin.Context) {
+	var webhook WebhookResource
+	if !selectWebhook(c, &webhook) {
+		return
+	}
+
+	limit := defaultLimit
+	if v, ok := c.GetQuery("limit"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxLimit {
+			c.JSON(http.StatusBadRequest, &ParamError{"limit", fmt.Sprintf("must be an integer between 1 and %d", maxLimit)})
+			return
+		}
+		limit = n
+	}
+	beforeID := math.MaxInt32
+	if v, ok := c.GetQuery("cursor"); ok {
+		cur, err := parseCursor(v)
+		if err != nil || cur.Sort != "-id" {
+			c.JSON(http.StatusBadRequest, &ParamError{"cursor", "malformed cursor"})
+			return
+		}
+		beforeID = cur.ID
+	}
+
+	deliveries := []WebhookDeliveryResource{}
+	if err := selectWebhookDeliveries.Select(&deliveries, webhook.ID, beforeID, limit+1); err != nil {
+		log.Printf("couldn't select from webhook_deliveries: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	var next *cursor
+	if len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+		next = &cursor{Sort: "-id", ID: deliveries[limit-1].ID}
+	}
+	ids := make(pq.Int64Array, len(deliveries))
+	indexes := map[int]int{}
+	for i, delivery := range deliveries {
+		ids[i] = int64(delivery.ID)
+		indexes[delivery.ID] = i
+		deliveries[i].Log = []WebhookAttemptResource{}
+	}
+	var attempts []WebhookAttemptResource
+	if err := selectWebhookAttempts.Select(&attempts, ids); err != nil {
+		log.Printf("couldn't select from webhook_attempts: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	for _, attempt := range attempts {
+		i := indexes[attempt.DeliveryID]
+		deliveries[i].Log = append(deliveries[i].Log, attempt)
+	}
+
+	setLinkHeader(c, next)
+	c.JSON(http.StatusOK, deliveries)
+}
+
+// postWebhooksIDDeliveriesIDRedeliverHandler queues a delivery again, e.g.
+// after it failed, with a fresh count of attempts. It answers 202, because
+// the delivery is attempted later
+func postWebhooksIDDeliveriesIDRedeliverHandler(c *gin.Context) {
+	var webhook WebhookResource
+	if !selectWebhook(c, &webhook) {
+		return
+	}
+	deliveryID, err := strconv.Atoi(c.Param("delivery_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		log.Printf("couldn't begin: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var delivery WebhookDeliveryResource
+	err = tx.Stmtx(redeliverWebhookDelivery).Get(&delivery, deliveryID, webhook.ID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, nil)
+		return
+	}
+	if err != nil {
+		log.Printf("couldn't update webhook_deliveries: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	resource := "/webhooks/" + strconv.Itoa(webhook.ID) + "/deliveries/" + strconv.Itoa(deliveryID)
+	if err := audit(c, tx, "redeliver", resource, nil, nil, nil); err != nil {
+		log.Printf("couldn't insert to audit_log: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("couldn't commit: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	wakeWebhooks()
+
+	delivery.Log = []WebhookAttemptResource{}
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+// webhookDelivery is a delivery claimed by an instance until Lease, with the
+// URL and the secret of its webhook
+type webhookDelivery struct {
+	ID        int
+	EventType string `db:"event_type"`
+	Payload   string
+	Attempts  int
+	Lease     time.Time `db:"next_attempt_at"`
+	URL       string
+	Secret    string
+}
+
+// deliverWebhooks attempts the pending deliveries that are due, until there
+// are none left
+func deliverWebhooks() {
+	for {
+		var deliveries []webhookDelivery
+		if err := claimWebhookDeliveries.Select(&deliveries, int(webhookLease.Seconds()), webhookBatch); err != nil {
+			log.Printf("couldn't update webhook_deliveries: %v", err)
+			return
+		}
+		for _, delivery := range deliveries {
+			if err := attemptWebhookDelivery(delivery); err != nil {
+				log.Printf("couldn't record the attempt of webhook delivery %d: %v", delivery.ID, err)
+			}
+		}
+		if len(deliveries) < webhookBatch {
+			return
+		}
+	}
+}
+
+// attemptWebhookDelivery posts a delivery to its webhook and records the
+// attempt. A delivery that isn't answered with a 2xx is attempted again later,
+// until it fails after webhookMaxAttempts attempts. The attempt isn't recorded
+// if the instance no longer holds the delivery, e.g. if it was queued again in
+// the meantime
+func attemptWebhookDelivery(delivery webhookDelivery) error {
+	var statusCode *int
+	var message *string
+	start := time.Now()
+	err := postWebhookDelivery(delivery, &statusCode)
+	duration := time.Since(start)
+	if err != nil {
+		s := err.Error()
+		message = &s
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var result sql.Result
+	switch {
+	case message == nil:
+		result, err = tx.Stmtx(deliverWebhookDelivery).Exec(delivery.ID, delivery.Lease)
+	case delivery.Attempts+1 >= webhookMaxAttempts:
+		result, err = tx.Stmtx(failWebhookDelivery).Exec(delivery.ID, delivery.Lease)
+	default:
+		wait := webhookBackoff * time.Duration(1<<uint(delivery.Attempts))
+		result, err = tx.Stmtx(retryWebhookDelivery).Exec(delivery.ID, delivery.Lease, int(wait.Seconds()))
+	}
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		log.Printf("dropping the attempt of webhook delivery %d: it was claimed again", delivery.ID)
+		return nil
+	}
+	if _, err := tx.Stmtx(insertWebhookAttempt).Exec(delivery.ID, statusCode, message, int(duration/time.Millisecond)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// postWebhookDelivery posts a delivery, signed with the secret of its webhook.
+// It sets statusCode if the webhook answered, and returns an error unless it
+// answered with a 2xx
+func postWebhookDelivery(delivery webhookDelivery, statusCode **int) error {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "task-manager-webhooks")
+	req.Header.Set("X-Webhook-Event", delivery.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(delivery.Secret, timestamp, body))
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	*statusCode = &resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s answered %s", delivery.URL, resp.Status)
+	}
+	return nil
+}
+
+// deliverWebhooksEvery attempts the deliveries that are due periodically, and
+// whenever it is woken up by new deliveries. It never returns
+func deliverWebhooksEvery(interval time.Duration) {
+	for {
+		deliverWebhooks()
+		select {
+		case <-webhookWake:
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"gopkg.in/gin-gonic/gin.v1"
+)
+
+// presenceChannel is the channel on which the IDs of the tasks whose viewers
+// changed are notified
+const presenceChannel = "task_presence"
+
+const (
+	// boardWriteWait is how long writing a message can take
+	boardWriteWait = 10 * time.Second
+	// boardPongWait is how long a connection can go without a pong
+	boardPongWait = 60 * time.Second
+	// boardPingPeriod is how often connections are pinged. It is shorter than
+	// boardPongWait, for the pong to arrive in time
+	boardPingPeriod = 50 * time.Second
+	// presenceRefresh is how often the viewers of tasks are refreshed, and
+	// presenceTTL how long they last without that, e.g. if their instance
+	// stopped
+	presenceRefresh = 30 * time.Second
+	presenceTTL     = 90 * time.Second
+)
+
+// upgrader upgrades the requests of GET /ws to WebSocket connections. It
+// rejects the requests of other origins, because browsers send the session
+// cookie with them
+var upgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 1024}
+
+// boardChannelRegexp matches the channels that a connection can subscribe to:
+// the events of every task, and the events of a task or of its comments
+var boardChannelRegexp = regexp.MustCompile(`^(tasks|task:([0-9]+)|comments:([0-9]+))$`)
+
+// boardRequest is a message sent by a client of GET /ws. LastEventID resumes
+// a subscription after the event that the client last received
+type boardRequest struct {
+	Type        string `json:"type"`
+	Channel     string `json:"channel"`
+	LastEventID *int   `json:"last_event_id"`
+}
+
+// boardConn is a WebSocket connection of a live board. Only its reading
+// goroutine subscribes and unsubscribes, whereas its writing goroutine writes
+// the messages that are queued in out
+type boardConn struct {
+	ws            *websocket.Conn
+	user          User
+	id            string
+	out           chan interface{}
+	done          chan struct{}
+	subscriptions map[string]*taskEventSubscriber
+}
+
+// send queues a message. A client that doesn't keep up is disconnected
+func (b *boardConn) send(message interface{}) {
+	select {
+	case b.out <- message:
+	case <-b.done:
+	default:
+		log.Printf("closing the WebSocket connection %s: too slow", b.id)
+		b.ws.Close()
+	}
+}
+
+// fail sends an error about a channel
+func (b *boardConn) fail(channel, message string) {
+	b.send(gin.H{"type": "error", "channel": channel, "message": message})
+}
+
+// boardHub tracks the connections of this instance that view each task, to
+// send them the viewers of the task
+type boardHub struct {
+	sync.Mutex
+	viewers map[int]map[*boardConn]bool
+}
+
+var hub = &boardHub{viewers: map[int]map[*boardConn]bool{}}
+
+func (h *boardHub) view(taskID int, b *boardConn) {
+	h.Lock()
+	defer h.Unlock()
+	if h.viewers[taskID] == nil {
+		h.viewers[taskID] = map[*boardConn]bool{}
+	}
+	h.viewers[taskID][b] = true
+}
+
+func (h *boardHub) leave(taskID int, b *boardConn) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.viewers[taskID], b)
+	if len(h.viewers[taskID]) == 0 {
+		delete(h.viewers, taskID)
+	}
+}
+
+// publishPresence sends the users viewing a task, on every instance, to the
+// connections of this one that view it
+func (h *boardHub) publishPresence(taskID int) {
+	h.Lock()
+	var conns []*boardConn
+	for b := range h.viewers[taskID] {
+		conns = append(conns, b)
+	}
+	h.Unlock()
+	if len(conns) == 0 {
+		return
+	}
+
+	viewers := []UserResource{}
+	if err := selectTaskViewers.Select(&viewers, taskID, int(presenceTTL.Seconds())); err != nil {
+		log.Printf("couldn't select from task_viewers: %v", err)
+		return
+	}
+	channel := "task:" + strconv.Itoa(taskID)
+	for _, b := range conns {
+		b.send(gin.H{"type": "presence", "channel": channel, "viewers": viewers})
+	}
+}
+
+// publishAllPresence sends the viewers of every task viewed on this instance
+func (h *boardHub) publishAllPresence() {
+	h.Lock()
+	var taskIDs []int
+	for taskID := range h.viewers {
+		taskIDs = append(taskIDs, taskID)
+	}
+	h.Unlock()
+	for _, taskID := range taskIDs {
+		h.publishPresence(taskID)
+	}
+}
+
+// getWSHandler upgrades to a WebSocket connection, on which clients subscribe
+// to channels: tasks, task:<id> and comments:<id>. They receive the task
+// events of these channels that they can view, like those of GET /events.
+// Subscribing to a task views it, and the subscribers of the task receive its
+// viewers whenever they change
+func getWSHandler(c *gin.Context) {
+	user, ok := authUser(c)
+	if !ok {
+		return
+	}
+
+	id, err := newToken()
+	if err != nil {
+		log.Printf("couldn't generate a connection ID: %v", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+	ws, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader answered the error
+		return
+	}
+	b := &boardConn{
+		ws:            ws,
+		user:          user,
+		id:            id,
+		out:           make(chan interface{}, 64),
+		done:          make(chan struct{}),
+		subscriptions: map[string]*taskEventSubscriber{},
+	}
+	go b.write()
+	defer b.close()
+
+	ws.SetReadLimit(4096)
+	ws.SetReadDeadline(time.Now().Add(boardPongWait))
+	ws.SetPongHandler(func(string) error {
+		return ws.SetReadDeadline(time.Now().Add(boardPongWait))
+	})
+	for {
+		var request boardRequest
+		err := ws.ReadJSON(&request)
+		switch err.(type) {
+		case nil:
+		case *json.SyntaxError, *json.UnmarshalTypeError:
+			b.fail("", "malformed message")
+			continue
+		default:
+			// The connection was closed
+			return
+		}
+		switch request.Type {
+		case "subscribe":
+			b.subscribe(request)
+		case "unsubscribe":
+			b.unsubscribe(request.Channel)
+		default:
+			b.fail(request.Channel, "type must be subscribe or unsubscribe")
+		}
+	}
+}
+
+// write writes the queued messages and pings the client, until the connection
+// is closed. It also refreshes the tasks that the connection views, and ends
+// the connection after eventStreamMaxAge, like GET /events
+func (b *boardConn) write() {
+	ping := time.NewTicker(boardPingPeriod)
+	defer ping.Stop()
+	refresh := time.NewTicker(presenceRefresh)
+	defer refresh.Stop()
+	maxAge := time.NewTimer(eventStreamMaxAge)
+	defer maxAge.Stop()
+	defer b.ws.Close()
+	for {
+		var err error
+		select {
+		case message := <-b.out:
+			b.ws.SetWriteDeadline(time.Now().Add(boardWriteWait))
+			err = b.ws.WriteJSON(message)
+		case <-ping.C:
+			err = b.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(boardWriteWait))
+		case <-refresh.C:
+			if _, err := touchTaskViewers.Exec(b.id); err != nil {
+				log.Printf("couldn't update task_viewers: %v", err)
+			}
+		case <-maxAge.C:
+			b.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "reconnect"), time.Now().Add(boardWriteWait))
+			return
+		case <-b.done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// close ends the subscriptions and the views of the connection
+func (b *boardConn) close() {
+	close(b.done)
+	b.ws.Close()
+	for channel := range b.subscriptions {
+		b.end(channel)
+	}
+}
+
+// subscribe subscribes the connection to a channel, and first sends the
+// events it missed if the request resumes a subscription
+func (b *boardConn) subscribe(request boardRequest) {
+	match := boardChannelRegexp.FindStringSubmatch(request.Channel)
+	if match == nil {
+		b.fail(request.Channel, "must be tasks, task:<id> or comments:<id>")
+		return
+	}
+	if b.subscriptions[request.Channel] != nil {
+		b.fail(request.Channel, "already subscribed")
+		return
+	}
+
+	s := &taskEventSubscriber{user: b.user, filter: taskEventFilter{kind: "task"}, events: make(chan TaskEventResource, 64)}
+	var taskID int
+	if match[2] != "" || match[3] != "" {
+		taskID, _ = strconv.Atoi(match[2] + match[3])
+		if match[3] != "" {
+			s.filter.kind = "comment"
+		}
+		s.filter.taskID = &taskID
+		var task TaskResource
+		err := selectTaskWhereID.Get(&task, taskID)
+		if err == sql.ErrNoRows {
+			b.fail(request.Channel, "unknown task")
+			return
+		}
+		if err != nil {
+			log.Printf("couldn't select from tasks: %v", err)
+			b.fail(request.Channel, "internal error")
+			return
+		}
+		role, err := taskRole(b.user, &task)
+		if err != nil {
+			log.Printf("couldn't select roles: %v", err)
+			b.fail(request.Channel, "internal error")
+			return
+		}
+		if !allows(role, taskView) || s.filter.kind == "comment" && !b.user.scopes.has("comments:read") {
+			b.fail(request.Channel, "forbidden")
+			return
+		}
+	}
+
+	broker.subscribe(s)
+	b.subscriptions[request.Channel] = s
+	b.send(gin.H{"type": "subscribed", "channel": request.Channel})
+	lastID := -1
+	if request.LastEventID != nil {
+		var err error
+		if lastID, err = s.sendMissed(*request.LastEventID, func(event TaskEventResource) {
+			b.send(gin.H{"type": "event", "channel": request.Channel, "event": event})
+		}); err != nil {
+			log.Printf("couldn't send the missed task events: %v", err)
+			b.fail(request.Channel, "couldn't send the missed events")
+		}
+	}
+	go func() {
+		for event := range s.events {
+			// The missed events may already have included it
+			if event.ID > lastID {
+				b.send(gin.H{"type": "event", "channel": request.Channel, "event": event})
+			}
+		}
+		if s.dropped {
+			log.Printf("closing the WebSocket connection %s: too slow", b.id)
+			b.ws.Close()
+		}
+	}()
+
+	if match[2] != "" {
+		hub.view(taskID, b)
+		if _, err := upsertTaskViewer.Exec(b.id, taskID, b.user.ID); err != nil {
+			log.Printf("couldn't insert to task_viewers: %v", err)
+		}
+	}
+}
+
+// unsubscribe unsubscribes the connection from a channel
+func (b *boardConn) unsubscribe(channel string) {
+	if b.subscriptions[channel] == nil {
+		b.fail(channel, "not subscribed")
+		return
+	}
+	b.end(channel)
+	b.send(gin.H{"type": "unsubscribed", "channel": channel})
+}
+
+// end ends the subscription of the connection to a channel, and stops viewing
+// its task
+func (b *boardConn) end(channel string) {
+	s := b.subscriptions[channel]
+	broker.unsubscribe(s)
+	delete(b.subscriptions, channel)
+
+	if s.filter.taskID != nil && s.filter.kind == "task" {
+		hub.leave(*s.filter.taskID, b)
+		if _, err := deleteTaskViewers.Exec(b.id, *s.filter.taskID); err != nil {
+			log.Printf("couldn't delete from task_viewers: %v", err)
+		}
+	}
+}
+
+// purgeTaskViewersEvery deletes the viewers that weren't refreshed in time
+// periodically. It never returns
+func purgeTaskViewersEvery(interval time.Duration) {
+	for {
+		if _, err := deleteStaleTaskViewers.Exec(int(presenceTTL.Seconds())); err != nil {
+			log.Printf("couldn't purge task_viewers: %v", err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v2"
+)
+
+// Workflow is the state machine of the task statuses
+type Workflow struct {
+	Initial     string       `yaml:"initial" json:"initial"`
+	Final       []string     `yaml:"final" json:"final"`
+	States      []string     `yaml:"states" json:"states"`
+	Transitions []Transition `yaml:"transitions" json:"transitions"`
+}
+
+// Transition is an allowed move between two statuses. If Roles isn't empty,
+// only users who have one of the roles on the task can make it
+type Transition struct {
+	From  string   `yaml:"from" json:"from"`
+	To    string   `yaml:"to" json:"to"`
+	Roles []string `yaml:"roles" json:"roles,omitempty"`
+}
+
+// workflow is the workflow loaded at boot
+var workflow *Workflow
+
+// loadWorkflow reads and validates a workflow definition from a YAML file
+func loadWorkflow(path string) (*Workflow, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var w Workflow
+	if err := yaml.Unmarshal(b, &w); err != nil {
+		return nil, fmt.Errorf("couldn't parse %s: %v", path, err)
+	}
+
+	if !w.HasState(w.Initial) {
+		return nil, fmt.Errorf("%s: unknown initial status %q", path, w.Initial)
+	}
+	for _, status := range w.Final {
+		if !w.HasState(status) {
+			return nil, fmt.Errorf("%s: unknown final status %q", path, status)
+		}
+	}
+	for _, t := range w.Transitions {
+		if !w.HasState(t.From) || !w.HasState(t.To) {
+			return nil, fmt.Errorf("%s: transition from %q to %q has an unknown status", path, t.From, t.To)
+		}
+		// A typo would make the transition impossible
+		for _, role := range t.Roles {
+			if roleRank(role) < 0 {
+				return nil, fmt.Errorf("%s: transition from %q to %q has an unknown role %q, must be one of %s", path, t.From, t.To, role, strings.Join(roles, ", "))
+			}
+		}
+	}
+	return &w, nil
+}
+
+// HasState tells whether status is a status of the workflow
+func (w *Workflow) HasState(status string) bool {
+	return contains(w.States, status)
+}
+
+// IsFinal tells whether status is a final status of the workflow
+func (w *Workflow) IsFinal(status string) bool {
+	return contains(w.Final, status)
+}
+
+// FinalStatuses returns the final statuses of the workflow, as a query argument
+func (w *Workflow) FinalStatuses() pq.StringArray {
+	return append(pq.StringArray{}, w.Final...)
+}
+
+// CheckTransition returns an error unless a user with the given roles on a
+// task can move it from one status to another
+func (w *Workflow) CheckTransition(from, to string, roles []string) error {
+	if !w.HasState(to) {
+		return fmt.Errorf("unknown status %q, must be one of %s", to, strings.Join(w.States, ", "))
+	}
+	for _, t := range w.Transitions {
+		if t.From != from || t.To != to {
+			continue
+		}
+		if len(t.Roles) == 0 {
+			return nil
+		}
+		for _, role := range roles {
+			if contains(t.Roles, role) {
+				return nil
+			}
+		}
+		return fmt.Errorf("moving from %q to %q requires one of the roles %s", from, to, strings.Join(t.Roles, ", "))
+	}
+	return fmt.Errorf("can't move from %q to %q", from, to)
+}
+
+// CheckInitial returns an error unless a user with the given roles can create
+// a task with the given status
+func (w *Workflow) CheckInitial(status string, roles []string) error {
+	if status == w.Initial {
+		return nil
+	}
+	return w.CheckTransition(w.Initial, status, roles)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}